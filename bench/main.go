@@ -0,0 +1,150 @@
+// Command bench measures the storage throughput against an SFTP server,
+// typically a local one, to tune the transfer parameters:
+//
+//	go run ./bench -location sftp://localhost/tmp/bench \
+//		-o max_packet=64KiB -o max_concurrent_requests=128
+//
+// The location must not exist or be empty, a repository is created there.
+// Without -location, it runs against an in-process server on a loopback
+// port, in a temporary directory, which needs no setup and makes it usable
+// as a smoke test.  Every packfile read back is checked against what was
+// written.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/PlakarKorp/integration-sftp/storage"
+	kstorage "github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/dustin/go-humanize"
+	"golang.org/x/sync/errgroup"
+)
+
+type params map[string]string
+
+func (p params) String() string { return fmt.Sprint(map[string]string(p)) }
+
+func (p params) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	p[key] = val
+	return nil
+}
+
+func report(op string, n int64, elapsed time.Duration) {
+	fmt.Printf("%s: %s in %s, %s/s\n", op, humanize.IBytes(uint64(n)),
+		elapsed.Round(time.Millisecond), humanize.IBytes(uint64(float64(n)/elapsed.Seconds())))
+}
+
+func run() error {
+	config := params{}
+	var location, size string
+	var count, parallel int
+
+	flag.StringVar(&location, "location", "", "sftp:// location of the benchmark repository, an in-process server if unset")
+	flag.StringVar(&size, "size", "16MiB", "size of each packfile")
+	flag.IntVar(&count, "count", 16, "number of packfiles")
+	flag.IntVar(&parallel, "parallel", 4, "number of concurrent transfers")
+	flag.Var(config, "o", "storage parameter as key=value, may be repeated")
+	flag.Parse()
+
+	if location == "" {
+		dir, err := os.MkdirTemp("", "plakar-bench-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		host, loopback, err := serveLoopback()
+		if err != nil {
+			return err
+		}
+		for key, value := range loopback {
+			if _, ok := config[key]; !ok {
+				config[key] = value
+			}
+		}
+		location = fmt.Sprintf("sftp://bench@%s%s", host, path.Join(dir, "repository"))
+	}
+	config["location"] = location
+
+	nbytes, err := humanize.ParseBytes(size)
+	if err != nil {
+		return fmt.Errorf("invalid -size: %w", err)
+	}
+
+	ctx := context.Background()
+	store, err := storage.NewStore(ctx, "sftp", config)
+	if err != nil {
+		return err
+	}
+	if err := store.Create(ctx, []byte("bench")); err != nil {
+		return err
+	}
+	defer store.Close(ctx)
+
+	data := make([]byte, nbytes)
+	rand.Read(data)
+
+	macs := make([]objects.MAC, count)
+	for i := range macs {
+		rand.Read(macs[i][:])
+	}
+
+	var g errgroup.Group
+	g.SetLimit(parallel)
+	t0 := time.Now()
+	for _, mac := range macs {
+		g.Go(func() error {
+			_, err := store.Put(ctx, kstorage.StorageResourcePackfile, mac, bytes.NewReader(data))
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	report("put", int64(nbytes)*int64(count), time.Since(t0))
+
+	t0 = time.Now()
+	for _, mac := range macs {
+		g.Go(func() error {
+			rd, err := store.Get(ctx, kstorage.StorageResourcePackfile, mac, nil)
+			if err != nil {
+				return err
+			}
+			defer rd.Close()
+			got, err := io.ReadAll(rd)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(got, data) {
+				return fmt.Errorf("packfile %x came back corrupted", mac)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	report("get", int64(nbytes)*int64(count), time.Since(t0))
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"net"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const loopbackPassword = "bench"
+
+// serveLoopback starts an SSH server on a loopback port, serving SFTP for
+// the whole filesystem, and returns the storage parameters to reach it
+// with the native transport.
+func serveLoopback() (host string, config params, err error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sshConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if subtle.ConstantTimeCompare(password, []byte(loopbackPassword)) != 1 {
+				return nil, fmt.Errorf("invalid password")
+			}
+			return nil, nil
+		},
+	}
+	sshConfig.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, sshConfig)
+		}
+	}()
+
+	return l.Addr().String(), params{
+		"transport":            "native",
+		"password":             loopbackPassword,
+		"host_key_fingerprint": ssh.FingerprintSHA256(signer.PublicKey()),
+	}, nil
+}
+
+func serveConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSession(channel, requests)
+	}
+}
+
+func serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		// a subsystem request carries the subsystem name as an SSH string
+		if req.Type != "subsystem" || string(req.Payload[min(4, len(req.Payload)):]) != "sftp" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			return
+		}
+		server.Serve()
+		server.Close()
+		return
+	}
+}
@@ -0,0 +1,220 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Limiter is a token bucket shared by all the transfers it throttles,
+// holding at most one second worth of tokens.  A nil Limiter does not
+// throttle.
+type Limiter struct {
+	rate     float64 // bytes per second
+	schedule []window
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// window is a time of day range, in minutes since midnight, which wraps
+// around midnight when end is before start.
+type window struct {
+	start, end int
+}
+
+func (w window) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start <= w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseSchedule parses a comma-separated list of HH:MM-HH:MM windows.
+func parseSchedule(value string) ([]window, error) {
+	var schedule []window
+	for _, item := range splitList(value) {
+		from, to, ok := strings.Cut(item, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid limit_schedule: %q", value)
+		}
+		start, err := parseClock(strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit_schedule: %q", value)
+		}
+		end, err := parseClock(strings.TrimSpace(to))
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit_schedule: %q", value)
+		}
+		schedule = append(schedule, window{start, end})
+	}
+	return schedule, nil
+}
+
+func parseRate(key, value string) (float64, error) {
+	n, err := humanize.ParseBytes(strings.TrimSuffix(strings.TrimSpace(value), "/s"))
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid %s: %q", key, value)
+	}
+	return float64(n), nil
+}
+
+// ParseLimits returns the limiters for upload_limit and download_limit,
+// nil when unset, which only apply during limit_schedule if given.
+func ParseLimits(params map[string]string) (upload *Limiter, download *Limiter, err error) {
+	schedule, err := parseSchedule(params["limit_schedule"])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if value := params["upload_limit"]; value != "" {
+		rate, err := parseRate("upload_limit", value)
+		if err != nil {
+			return nil, nil, err
+		}
+		upload = &Limiter{rate: rate, schedule: schedule}
+	}
+
+	if value := params["download_limit"]; value != "" {
+		rate, err := parseRate("download_limit", value)
+		if err != nil {
+			return nil, nil, err
+		}
+		download = &Limiter{rate: rate, schedule: schedule}
+	}
+
+	return upload, download, nil
+}
+
+func (l *Limiter) active(now time.Time) bool {
+	if len(l.schedule) == 0 {
+		return true
+	}
+	for _, w := range l.schedule {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// burst is the largest amount of bytes to wait for at once.
+func (l *Limiter) burst() int {
+	return max(int(l.rate), 1)
+}
+
+// Wait blocks until n bytes may be transferred.
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if !l.active(now) {
+		return
+	}
+
+	l.mu.Lock()
+	if l.last.IsZero() {
+		l.tokens = l.rate
+	} else {
+		l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	// the tokens are already taken, so concurrent callers queue up
+	// behind this one
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
+
+type limitedReader struct {
+	rd      io.Reader
+	limiter *Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.limiter.burst() {
+		p = p[:r.limiter.burst()]
+	}
+	n, err := r.rd.Read(p)
+	r.limiter.Wait(n)
+	return n, err
+}
+
+// limitedReadSeeker keeps the reader seekable, only the bytes past the
+// furthest point read so far are throttled, so that reading the input
+// again, to hash it for instance, is not taken for a transfer.
+type limitedReadSeeker struct {
+	limitedReader
+	pos  int64
+	high int64
+}
+
+func (r *limitedReadSeeker) Read(p []byte) (int, error) {
+	if len(p) > r.limiter.burst() {
+		p = p[:r.limiter.burst()]
+	}
+	n, err := r.rd.Read(p)
+	start := max(r.pos, r.high)
+	r.pos += int64(n)
+	if r.pos > start {
+		r.limiter.Wait(int(r.pos - start))
+		r.high = r.pos
+	}
+	return n, err
+}
+
+func (r *limitedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.rd.(io.Seeker).Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
+
+// Reader throttles the reads from rd.
+func (l *Limiter) Reader(rd io.Reader) io.Reader {
+	if l == nil {
+		return rd
+	}
+	if _, ok := rd.(io.ReadSeeker); ok {
+		return &limitedReadSeeker{limitedReader: limitedReader{rd, l}}
+	}
+	return &limitedReader{rd, l}
+}
+
+type limitedReadCloser struct {
+	limitedReader
+	closer io.Closer
+}
+
+func (r *limitedReadCloser) Close() error {
+	return r.closer.Close()
+}
+
+// ReadCloser throttles the reads from rd.
+func (l *Limiter) ReadCloser(rd io.ReadCloser) io.ReadCloser {
+	if l == nil {
+		return rd
+	}
+	return &limitedReadCloser{limitedReader{rd, l}, rd}
+}
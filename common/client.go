@@ -0,0 +1,349 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	defaultMaxRetries   = 3
+	defaultRetryBackoff = 500 * time.Millisecond
+)
+
+// Client is an SFTP session that re-establishes the SSH transport and the
+// session when the connection drops.  Idempotent operations are retried
+// with exponential backoff, others fail but the next call reconnects.
+type Client struct {
+	endpoint *url.URL
+	params   map[string]string
+
+	retries int
+	backoff time.Duration
+
+	mu     sync.Mutex
+	client *sftp.Client
+
+	rawMu sync.Mutex
+	raw   *rawSession
+
+	conn    *connLimits
+	handles chan struct{} // nil when unbounded
+}
+
+func retryParams(params map[string]string) (int, time.Duration, error) {
+	retries := defaultMaxRetries
+	if value := params["max_retries"]; value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid max_retries: %q", value)
+		}
+		retries = n
+	}
+
+	backoff := defaultRetryBackoff
+	if value := params["retry_backoff"]; value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return 0, 0, fmt.Errorf("invalid retry_backoff: %q", value)
+		}
+		backoff = d
+	}
+
+	return retries, backoff, nil
+}
+
+func NewClient(endpoint *url.URL, params map[string]string) (*Client, error) {
+	retries, backoff, err := retryParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := Connect(endpoint, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// cached by Connect
+	conn, err := serverLimits(endpoint, params)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &Client{
+		endpoint: endpoint,
+		params:   params,
+		retries:  retries,
+		backoff:  backoff,
+		client:   client,
+		conn:     conn,
+		handles:  conn.newHandles(),
+	}, nil
+}
+
+// IsConnectionLost reports whether err means the SFTP session is gone.
+func IsConnectionLost(err error) bool {
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.Is(err, sftp.ErrSSHFxNoConnection) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+func (c *Client) session() (*sftp.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		client, err := Connect(c.endpoint, c.params)
+		if err != nil {
+			return nil, err
+		}
+		c.client = client
+	}
+	return c.client, nil
+}
+
+// invalidate drops the session if it is still the one that failed, so
+// that concurrent callers hitting the same failure reconnect only once.
+func (c *Client) invalidate(failed *sftp.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == failed {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+func (c *Client) do(idempotent bool, fn func(*sftp.Client) error) error {
+	for attempt := 0; ; attempt++ {
+		client, err := c.session()
+		if err == nil {
+			err = fn(client)
+			if err == nil || !IsConnectionLost(err) {
+				return err
+			}
+			c.invalidate(client)
+			if !idempotent {
+				return err
+			}
+		}
+
+		if attempt >= c.retries {
+			return err
+		}
+		time.Sleep(c.backoff << attempt)
+	}
+}
+
+// Retry runs fn, a sequence of operations on c that is safe to restart,
+// again when it fails on a connection loss, within the retry budget.
+func (c *Client) Retry(fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !IsConnectionLost(err) || attempt >= c.retries {
+			return err
+		}
+		time.Sleep(c.backoff << attempt)
+	}
+}
+
+func (c *Client) Close() error {
+	c.rawMu.Lock()
+	if c.raw != nil {
+		c.raw.Close()
+		c.raw = nil
+	}
+	c.rawMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
+
+func (c *Client) HasExtension(name string) (string, bool) {
+	client, err := c.session()
+	if err != nil {
+		return "", false
+	}
+	return client.HasExtension(name)
+}
+
+func (c *Client) Stat(p string) (info os.FileInfo, err error) {
+	err = c.do(true, func(client *sftp.Client) error {
+		info, err = client.Stat(p)
+		return err
+	})
+	return
+}
+
+func (c *Client) Lstat(p string) (info os.FileInfo, err error) {
+	err = c.do(true, func(client *sftp.Client) error {
+		info, err = client.Lstat(p)
+		return err
+	})
+	return
+}
+
+// Limits returns the limits advertised by the server, all 0 when it does
+// not support limits@openssh.com.
+func (c *Client) Limits() ServerLimits {
+	return c.conn.limits
+}
+
+func (c *Client) ReadDir(p string) (entries []os.FileInfo, err error) {
+	release := c.acquireHandle()
+	defer release()
+
+	err = c.do(true, func(client *sftp.Client) error {
+		entries, err = client.ReadDir(p)
+		return err
+	})
+	return
+}
+
+func (c *Client) ReadLink(p string) (target string, err error) {
+	err = c.do(true, func(client *sftp.Client) error {
+		target, err = client.ReadLink(p)
+		return err
+	})
+	return
+}
+
+func (c *Client) Open(p string) (*File, error) {
+	release := c.acquireHandle()
+
+	var fp *sftp.File
+	err := c.do(true, func(client *sftp.Client) (err error) {
+		fp, err = client.Open(p)
+		return err
+	})
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &File{fp, release}, nil
+}
+
+func (c *Client) Remove(p string) error {
+	retried := false
+	return c.do(true, func(client *sftp.Client) error {
+		err := client.Remove(p)
+		// the previous attempt may have removed it before the connection dropped
+		if retried && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		retried = true
+		return err
+	})
+}
+
+func (c *Client) StatVFS(p string) (stat *sftp.StatVFS, err error) {
+	err = c.do(true, func(client *sftp.Client) error {
+		stat, err = client.StatVFS(p)
+		return err
+	})
+	return
+}
+
+func (c *Client) MkdirAll(p string) error {
+	return c.do(true, func(client *sftp.Client) error {
+		return client.MkdirAll(p)
+	})
+}
+
+func (c *Client) Chmod(p string, mode os.FileMode) error {
+	return c.do(true, func(client *sftp.Client) error {
+		return client.Chmod(p, mode)
+	})
+}
+
+func (c *Client) Mkdir(p string) error {
+	return c.do(false, func(client *sftp.Client) error {
+		return client.Mkdir(p)
+	})
+}
+
+func (c *Client) Create(p string) (*File, error) {
+	return c.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+func (c *Client) OpenFile(p string, flags int) (*File, error) {
+	release := c.acquireHandle()
+
+	var fp *sftp.File
+	err := c.do(false, func(client *sftp.Client) (err error) {
+		fp, err = client.OpenFile(p, flags)
+		return err
+	})
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &File{fp, release}, nil
+}
+
+func (c *Client) Rename(oldname, newname string) error {
+	return c.do(false, func(client *sftp.Client) error {
+		return client.Rename(oldname, newname)
+	})
+}
+
+func (c *Client) Symlink(oldname, newname string) error {
+	return c.do(false, func(client *sftp.Client) error {
+		return client.Symlink(oldname, newname)
+	})
+}
+
+func (c *Client) Link(oldname, newname string) error {
+	return c.do(false, func(client *sftp.Client) error {
+		return client.Link(oldname, newname)
+	})
+}
+
+func (c *Client) PosixRename(oldname, newname string) error {
+	return c.do(false, func(client *sftp.Client) error {
+		return client.PosixRename(oldname, newname)
+	})
+}
+
+// Replace renames oldname to newname, replacing newname if it exists.  It
+// is atomic with posix-rename@openssh.com, otherwise newname is removed
+// first and briefly does not exist.
+func (c *Client) Replace(oldname, newname string) error {
+	if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+		return c.PosixRename(oldname, newname)
+	}
+
+	err := c.Rename(oldname, newname)
+	if err == nil {
+		return nil
+	}
+	// plain SFTPv3 rename does not replace an existing file
+	if _, serr := c.Lstat(newname); serr != nil {
+		return err
+	}
+
+	warnOnce("sftp: %s: server lacks posix-rename@openssh.com, replacing files is not atomic", c.endpoint.Host)
+	if err := c.Remove(newname); err != nil {
+		return err
+	}
+	return c.Rename(oldname, newname)
+}
@@ -0,0 +1,193 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	latencySamples = 5
+	probeSize      = 1024 * 1024
+)
+
+// Extensions whose presence changes how the connectors behave.
+var notableExtensions = []string{
+	"posix-rename@openssh.com",
+	"statvfs@openssh.com",
+	"hardlink@openssh.com",
+	"fsync@openssh.com",
+	"limits@openssh.com",
+}
+
+// Diagnostics describes what a server supports and how it performs, to
+// validate a target before relying on it.
+type Diagnostics struct {
+	Path            string
+	ProtocolVersion uint32
+	Extensions      map[string]string // all advertised extensions
+	Latency         time.Duration     // median round-trip of a stat
+	Limits          ServerLimits
+	FreeSpace       uint64 // bytes available, with statvfs@openssh.com
+	TotalSpace      uint64 // 0 when unknown
+
+	// The remaining fields are only filled when probing writes.
+	WritesProbed bool
+	UploadRate   int64 // bytes per second
+	DownloadRate int64 // bytes per second
+	Writable     bool
+	Renamable    bool
+	Deletable    bool
+
+	// Errors met while probing, the probe stops at the first failing step.
+	Errors []error
+}
+
+// Supports reports whether the server advertises ext.
+func (d *Diagnostics) Supports(ext string) bool {
+	_, ok := d.Extensions[ext]
+	return ok
+}
+
+// Lines formats the report, one line per item.
+func (d *Diagnostics) Lines() []string {
+	lines := []string{
+		fmt.Sprintf("path: %s", d.Path),
+		fmt.Sprintf("protocol version: %d", d.ProtocolVersion),
+		fmt.Sprintf("latency: %s", d.Latency.Round(time.Microsecond)),
+	}
+	for _, ext := range notableExtensions {
+		lines = append(lines, fmt.Sprintf("extension %s: %v", ext, d.Supports(ext)))
+	}
+	if d.Supports("limits@openssh.com") {
+		lines = append(lines, fmt.Sprintf("limits: packet %s, read %s, write %s, open handles %d",
+			humanize.IBytes(d.Limits.MaxPacketLength), humanize.IBytes(d.Limits.MaxReadLength),
+			humanize.IBytes(d.Limits.MaxWriteLength), d.Limits.MaxOpenHandles))
+	}
+	if d.TotalSpace > 0 {
+		lines = append(lines, fmt.Sprintf("free space: %s of %s",
+			humanize.IBytes(d.FreeSpace), humanize.IBytes(d.TotalSpace)))
+	}
+	if d.WritesProbed {
+		lines = append(lines, fmt.Sprintf("throughput: %s/s up, %s/s down",
+			humanize.IBytes(uint64(d.UploadRate)), humanize.IBytes(uint64(d.DownloadRate))))
+		lines = append(lines, fmt.Sprintf("write: %v, rename: %v, delete: %v", d.Writable, d.Renamable, d.Deletable))
+	}
+	return lines
+}
+
+// Log writes the report to the logger of ctx, errors as warnings.
+func (d *Diagnostics) Log(ctx context.Context) {
+	logger := Logger(ctx)
+	for _, line := range d.Lines() {
+		logger.Info("sftp: %s", line)
+	}
+	for _, err := range d.Errors {
+		logger.Warn("sftp: %s: %v", d.Path, err)
+	}
+}
+
+// Diagnose probes the server and the directory p.  With probeWrites, a
+// test file is written, read back, renamed and deleted in p to measure
+// throughput and check permissions.  The returned error is only set when
+// p can not be reached at all.
+func Diagnose(ctx context.Context, client *Client, p string, probeWrites bool) (*Diagnostics, error) {
+	d := &Diagnostics{Path: p}
+
+	var samples []time.Duration
+	for range latencySamples {
+		t0 := time.Now()
+		if _, err := client.Lstat(p); err != nil {
+			return d, err
+		}
+		samples = append(samples, time.Since(t0))
+	}
+	slices.Sort(samples)
+	d.Latency = samples[len(samples)/2]
+
+	version, exts, err := client.ServerInfo()
+	if err != nil {
+		d.Errors = append(d.Errors, fmt.Errorf("server info: %w", err))
+	}
+	d.ProtocolVersion = version
+	d.Extensions = exts
+	d.Limits = client.Limits()
+
+	if d.Supports("statvfs@openssh.com") {
+		if d.FreeSpace, d.TotalSpace, err = freeSpace(client, p); err != nil {
+			d.Errors = append(d.Errors, fmt.Errorf("free space: %w", err))
+		}
+	}
+
+	if probeWrites {
+		d.WritesProbed = true
+		if err := probe(client, d); err != nil {
+			d.Errors = append(d.Errors, err)
+		}
+	}
+
+	return d, nil
+}
+
+func probe(client *Client, d *Diagnostics) error {
+	data := make([]byte, probeSize)
+	rand.Read(data)
+
+	name := path.Join(d.Path, fmt.Sprintf(".plakar-probe.%x", data[:8]))
+	renamed := name + ".renamed"
+
+	t0 := time.Now()
+	fp, err := client.Create(name)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if _, err := fp.ReadFrom(bytes.NewReader(data)); err != nil {
+		fp.Close()
+		client.Remove(name)
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := fp.Close(); err != nil {
+		client.Remove(name)
+		return fmt.Errorf("write: %w", err)
+	}
+	d.UploadRate = rate(probeSize, time.Since(t0))
+	d.Writable = true
+
+	t0 = time.Now()
+	rd, err := client.Open(name)
+	if err != nil {
+		client.Remove(name)
+		return fmt.Errorf("read: %w", err)
+	}
+	got, err := io.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		client.Remove(name)
+		return fmt.Errorf("read: %w", err)
+	}
+	d.DownloadRate = rate(probeSize, time.Since(t0))
+	if !bytes.Equal(got, data) {
+		client.Remove(name)
+		return fmt.Errorf("read: test file came back corrupted")
+	}
+
+	if err := client.Rename(name, renamed); err != nil {
+		client.Remove(name)
+		return fmt.Errorf("rename: %w", err)
+	}
+	d.Renamable = true
+
+	if err := client.Remove(renamed); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	d.Deletable = true
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"fmt"
+)
+
+// Durability is how far a write is flushed before it is considered done.
+type Durability int
+
+const (
+	// DurabilityNone leaves flushing to the server.
+	DurabilityNone Durability = iota
+	// DurabilityFile flushes file contents before they are renamed into
+	// place.
+	DurabilityFile
+	// DurabilityFull also flushes the directory the file is renamed in.
+	DurabilityFull
+)
+
+// ParseDurability reads the durability parameter, none by default so that
+// writes cost no more round trips than they used to.
+func ParseDurability(params map[string]string) (Durability, error) {
+	switch value := params["durability"]; value {
+	case "", "none":
+		return DurabilityNone, nil
+	case "file":
+		return DurabilityFile, nil
+	case "full":
+		return DurabilityFull, nil
+	default:
+		return DurabilityNone, fmt.Errorf("invalid durability: %q", value)
+	}
+}
+
+// Sync flushes f to stable storage with fsync@openssh.com.  Servers that
+// lack it are warned about once and f is left as is.
+func (c *Client) Sync(f *File) error {
+	if data, ok := c.HasExtension("fsync@openssh.com"); !ok || data != "1" {
+		warnOnce("sftp: %s: server lacks fsync@openssh.com, writes are not flushed to stable storage", c.endpoint.Host)
+		return nil
+	}
+	return f.Sync()
+}
+
+// SyncDir flushes dir so that the files renamed into it persist.  Not all
+// servers let a directory be opened, this is best effort.
+func (c *Client) SyncDir(dir string) {
+	if data, ok := c.HasExtension("fsync@openssh.com"); !ok || data != "1" {
+		return
+	}
+
+	f, err := c.Open(dir)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	f.Sync()
+}
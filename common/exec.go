@@ -0,0 +1,142 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Command is a command running on the server, with its standard input
+// closed.
+type Command struct {
+	Stdout io.Reader
+	Stderr io.Reader
+
+	wait func() error
+	kill func()
+}
+
+// Wait waits for the command to exit, once Stdout and Stderr are consumed.
+func (cmd *Command) Wait() error {
+	return cmd.wait()
+}
+
+// Kill stops the command, Wait must still be called.
+func (cmd *Command) Kill() {
+	cmd.kill()
+}
+
+// ExitStatus returns the exit status of a command that ran to completion
+// but failed, -1 for any other error.
+func ExitStatus(err error) int {
+	var sshErr *ssh.ExitError
+	if errors.As(err, &sshErr) {
+		return sshErr.ExitStatus()
+	}
+	var execErr *exec.ExitError
+	if errors.As(err, &execErr) {
+		// ssh(1) exits with 255 on its own errors
+		if status := execErr.ExitCode(); status != 255 {
+			return status
+		}
+	}
+	return -1
+}
+
+// ShellQuote quotes s for a POSIX shell.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Exec runs command through the shell of the remote user, over the
+// ControlMaster of the ssh transport or the shared connection of the native
+// one.  Servers restricted to sftp refuse it or run their sftp server
+// instead, which produces no output.
+func (c *Client) Exec(command string) (*Command, error) {
+	switch c.params["transport"] {
+	case "", "ssh":
+		return execCommand(c.endpoint, c.params, command)
+	case "native":
+		return nativeCommand(c.endpoint, c.params, command)
+	default:
+		return nil, fmt.Errorf("unsupported transport: %q", c.params["transport"])
+	}
+}
+
+func execCommand(endpoint *url.URL, params map[string]string, command string) (*Command, error) {
+	sock, err := ensureMaster(endpoint, params)
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := execArgs(endpoint, params, sock)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, "--", command)
+
+	cmd := exec.Command("ssh", args...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &Command{
+		Stdout: stdout,
+		Stderr: stderr,
+		wait:   cmd.Wait,
+		kill:   func() { cmd.Process.Kill() },
+	}, nil
+}
+
+func nativeCommand(endpoint *url.URL, params map[string]string, command string) (*Command, error) {
+	conn, err := ensureNative(endpoint, params)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	if err := session.Start(command); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return &Command{
+		Stdout: stdout,
+		Stderr: stderr,
+		wait: func() error {
+			defer session.Close()
+			return session.Wait()
+		},
+		kill: func() { session.Close() },
+	}, nil
+}
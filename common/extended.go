@@ -0,0 +1,299 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"strings"
+)
+
+// ErrUnsupportedExtension is returned when the server does not advertise
+// the SFTP extension needed for a request.
+var ErrUnsupportedExtension = errors.New("sftp extension not supported by server")
+
+const (
+	fxpInit          = 1
+	fxpVersion       = 2
+	fxpStatus        = 101
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+
+	maxRawPacket = 256 * 1024
+)
+
+// rawSession is a bare SFTP channel used to issue the extended requests
+// that pkg/sftp has no API for.  It is not safe for concurrent use.
+type rawSession struct {
+	rd      io.Reader
+	wr      io.WriteCloser
+	version uint32
+	exts    map[string]string
+	id      uint32
+}
+
+type packetBuilder []byte
+
+func (b packetBuilder) uint32(v uint32) packetBuilder {
+	return binary.BigEndian.AppendUint32(b, v)
+}
+
+func (b packetBuilder) uint64(v uint64) packetBuilder {
+	return binary.BigEndian.AppendUint64(b, v)
+}
+
+func (b packetBuilder) string(s string) packetBuilder {
+	return append(b.uint32(uint32(len(s))), s...)
+}
+
+type packetReader []byte
+
+func (r *packetReader) uint32() (uint32, error) {
+	if len(*r) < 4 {
+		return 0, fmt.Errorf("short sftp packet")
+	}
+	v := binary.BigEndian.Uint32(*r)
+	*r = (*r)[4:]
+	return v, nil
+}
+
+func (r *packetReader) uint64() (uint64, error) {
+	if len(*r) < 8 {
+		return 0, fmt.Errorf("short sftp packet")
+	}
+	v := binary.BigEndian.Uint64(*r)
+	*r = (*r)[8:]
+	return v, nil
+}
+
+func (r *packetReader) string() (string, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return "", err
+	}
+	if uint32(len(*r)) < n {
+		return "", fmt.Errorf("short sftp packet")
+	}
+	v := string((*r)[:n])
+	*r = (*r)[n:]
+	return v, nil
+}
+
+func openRawSession(endpoint *url.URL, params map[string]string) (*rawSession, error) {
+	stdout, stdin, sshErr, err := sftpPipe(endpoint, params)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := &rawSession{
+		rd:   stdout,
+		wr:   stdin,
+		exts: make(map[string]string),
+	}
+
+	typ, data, err := raw.roundtrip(fxpInit, packetBuilder{}.uint32(3))
+	if err != nil {
+		raw.Close()
+		if err := sshErr(); err != nil {
+			return nil, err
+		}
+		return nil, err
+	}
+	if typ != fxpVersion {
+		raw.Close()
+		return nil, fmt.Errorf("unexpected sftp packet type %d", typ)
+	}
+
+	rd := packetReader(data)
+	if raw.version, err = rd.uint32(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	for len(rd) > 0 {
+		name, err := rd.string()
+		if err != nil {
+			raw.Close()
+			return nil, err
+		}
+		value, err := rd.string()
+		if err != nil {
+			raw.Close()
+			return nil, err
+		}
+		raw.exts[name] = value
+	}
+
+	return raw, nil
+}
+
+func (raw *rawSession) roundtrip(typ byte, payload []byte) (byte, []byte, error) {
+	pkt := packetBuilder{}.uint32(uint32(len(payload) + 1))
+	pkt = append(pkt, typ)
+	pkt = append(pkt, payload...)
+	if _, err := raw.wr.Write(pkt); err != nil {
+		return 0, nil, err
+	}
+
+	var hdr [5]byte
+	if _, err := io.ReadFull(raw.rd, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(hdr[:4])
+	if length < 1 || length > maxRawPacket {
+		return 0, nil, fmt.Errorf("invalid sftp packet length %d", length)
+	}
+
+	data := make([]byte, length-1)
+	if _, err := io.ReadFull(raw.rd, data); err != nil {
+		return 0, nil, err
+	}
+	return hdr[4], data, nil
+}
+
+// extended sends the extended request name, provided the server
+// advertises ext, and returns the payload of its reply after the id.
+func (raw *rawSession) extended(ext, name string, request []byte) ([]byte, error) {
+	if _, ok := raw.exts[ext]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedExtension, ext)
+	}
+
+	raw.id++
+	payload := packetBuilder{}.uint32(raw.id).string(name)
+	payload = append(payload, request...)
+
+	typ, data, err := raw.roundtrip(fxpExtended, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	rd := packetReader(data)
+	id, err := rd.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if id != raw.id {
+		return nil, fmt.Errorf("unexpected sftp reply id %d", id)
+	}
+
+	switch typ {
+	case fxpExtendedReply:
+		return rd, nil
+	case fxpStatus:
+		code, err := rd.uint32()
+		if err != nil {
+			return nil, err
+		}
+		msg, _ := rd.string()
+		return nil, fmt.Errorf("%s: sftp status %d: %s", name, code, msg)
+	default:
+		return nil, fmt.Errorf("unexpected sftp packet type %d", typ)
+	}
+}
+
+func (raw *rawSession) Close() error {
+	return raw.wr.Close()
+}
+
+// withRaw runs fn on the raw session, opening it first if needed.  It is
+// kept open until the client is closed.
+func (c *Client) withRaw(fn func(*rawSession) error) error {
+	return c.Retry(func() error {
+		c.rawMu.Lock()
+		defer c.rawMu.Unlock()
+
+		if c.raw == nil {
+			raw, err := openRawSession(c.endpoint, c.params)
+			if err != nil {
+				return err
+			}
+			c.raw = raw
+		}
+
+		err := fn(c.raw)
+		if IsConnectionLost(err) {
+			c.raw.Close()
+			c.raw = nil
+		}
+		return err
+	})
+}
+
+func (c *Client) extended(ext, name string, request []byte) (reply []byte, err error) {
+	// spare opening a channel for nothing
+	if _, ok := c.conn.exts[ext]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedExtension, ext)
+	}
+
+	err = c.withRaw(func(raw *rawSession) error {
+		reply, err = raw.extended(ext, name, request)
+		return err
+	})
+	return
+}
+
+// ServerInfo returns the SFTP protocol version negotiated with the server
+// and the extensions it advertises.
+func (c *Client) ServerInfo() (version uint32, exts map[string]string, err error) {
+	return c.conn.version, maps.Clone(c.conn.exts), nil
+}
+
+// CheckFile asks the server to hash the file at p with the first of
+// algorithms it supports, using the check-file extension.
+func (c *Client) CheckFile(p string, algorithms ...string) (string, []byte, error) {
+	request := packetBuilder{}.
+		string(p).
+		string(strings.Join(algorithms, ",")).
+		uint64(0). // start offset
+		uint64(0). // length, 0 for the whole file
+		uint32(0)  // block size, 0 for a single hash
+
+	reply, err := c.extended("check-file", "check-file-name", request)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rd := packetReader(reply)
+	algo, err := rd.string()
+	if err != nil {
+		return "", nil, err
+	}
+	// some servers echo the reply name before the algorithm
+	if algo == "check-file" {
+		if algo, err = rd.string(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return algo, []byte(rd), nil
+}
+
+// MD5Hash asks the server for the MD5 of the file at p, using the
+// md5-hash extension.
+func (c *Client) MD5Hash(p string) ([]byte, error) {
+	request := packetBuilder{}.
+		string(p).
+		uint64(0). // start offset
+		uint64(0). // length, 0 for the whole file
+		string("") // no quick-check hash
+
+	reply, err := c.extended("md5-hash", "md5-hash", request)
+	if err != nil {
+		return nil, err
+	}
+
+	rd := packetReader(reply)
+	sum, err := rd.string()
+	if err != nil {
+		return nil, err
+	}
+	// some servers echo the reply name before the hash
+	if sum == "md5-hash" {
+		if sum, err = rd.string(); err != nil {
+			return nil, err
+		}
+	}
+
+	return []byte(sum), nil
+}
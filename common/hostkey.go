@@ -0,0 +1,245 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyError is returned when the key presented by the server fails
+// verification against the configured known_hosts files or pinned
+// fingerprint.
+type HostKeyError struct {
+	Host        string
+	Fingerprint string // SHA256 fingerprint of the presented key
+	Err         error
+}
+
+func (e *HostKeyError) Error() string {
+	return fmt.Sprintf("host key verification failed for %s (presented %s): %v", e.Host, e.Fingerprint, e.Err)
+}
+
+func (e *HostKeyError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	errFingerprintMismatch = errors.New("fingerprint does not match pinned host_key_fingerprint")
+	errUnknownHost         = errors.New("host is not present in known_hosts")
+)
+
+// splitList splits a comma-separated parameter, dropping empty items.
+func splitList(value string) []string {
+	var ret []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
+func expandHome(file string) string {
+	if rest, ok := strings.CutPrefix(file, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return file
+}
+
+func knownHostsFiles(params map[string]string) ([]string, error) {
+	if value := params["known_hosts"]; value != "" {
+		var files []string
+		for _, file := range splitList(value) {
+			file = expandHome(file)
+			if _, err := os.Stat(file); err != nil {
+				return nil, fmt.Errorf("known_hosts: %w", err)
+			}
+			files = append(files, file)
+		}
+		return files, nil
+	}
+
+	var files []string
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".ssh", "known_hosts"))
+	}
+	files = append(files, "/etc/ssh/ssh_known_hosts")
+
+	var existing []string
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		}
+	}
+	return existing, nil
+}
+
+func normalizeFingerprint(fp string) string {
+	fp = strings.TrimSpace(fp)
+	fp = strings.TrimPrefix(fp, "SHA256:")
+	fp = strings.TrimRight(fp, "=")
+	return "SHA256:" + fp
+}
+
+func nativeHostKeyCallback(params map[string]string) (ssh.HostKeyCallback, error) {
+	pinned := splitList(params["host_key_fingerprint"])
+	explicit := params["known_hosts"] != "" || len(pinned) != 0
+
+	if params["insecure_ignore_host_key"] == "true" {
+		if explicit {
+			return nil, fmt.Errorf("insecure_ignore_host_key can not be combined with known_hosts or host_key_fingerprint")
+		}
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	for i := range pinned {
+		pinned[i] = normalizeFingerprint(pinned[i])
+	}
+
+	var check ssh.HostKeyCallback
+	if params["known_hosts"] != "" || len(pinned) == 0 {
+		files, err := knownHostsFiles(params)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no known_hosts file found to verify host key")
+		}
+		check, err = knownhosts.New(files...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load known_hosts: %w", err)
+		}
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+
+		if len(pinned) != 0 && !slices.Contains(pinned, strings.TrimRight(fingerprint, "=")) {
+			return &HostKeyError{Host: hostname, Fingerprint: fingerprint, Err: errFingerprintMismatch}
+		}
+
+		if check != nil {
+			if err := check(hostname, remote, key); err != nil {
+				var keyErr *knownhosts.KeyError
+				if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+					err = fmt.Errorf("%w: %w", errUnknownHost, err)
+				}
+				return &HostKeyError{Host: hostname, Fingerprint: fingerprint, Err: err}
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// lookupKey is never in known_hosts, checking it lists the keys known for
+// a host.
+type lookupKey struct{}
+
+func (lookupKey) Type() string                                 { return "" }
+func (lookupKey) Marshal() []byte                              { return nil }
+func (lookupKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("lookup key") }
+
+// knownHostKeyTypes returns the types of the keys known_hosts lists for
+// address, none when it is not checked against known_hosts.
+func knownHostKeyTypes(params map[string]string, address string) []string {
+	if params["insecure_ignore_host_key"] == "true" {
+		return nil
+	}
+	if params["known_hosts"] == "" && params["host_key_fingerprint"] != "" {
+		return nil
+	}
+
+	files, err := knownHostsFiles(params)
+	if err != nil || len(files) == 0 {
+		return nil
+	}
+	check, err := knownhosts.New(files...)
+	if err != nil {
+		return nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(check(address, &net.TCPAddr{}, lookupKey{}), &keyErr) {
+		return nil
+	}
+
+	var types []string
+	for _, known := range keyErr.Want {
+		types = append(types, known.Key.Type())
+	}
+	return types
+}
+
+// nativeHostKeyAlgorithms returns the host_key_algorithms, or when unset
+// the algorithms of the keys known_hosts lists for address, like ssh(1)
+// does, so that the server is not asked for a key of another type.  nil
+// leaves the choice to the defaults.
+func nativeHostKeyAlgorithms(params map[string]string, address string) ([]string, error) {
+	algorithms := splitList(params["host_key_algorithms"])
+
+	supported := slices.Concat(ssh.SupportedAlgorithms().HostKeys, ssh.InsecureAlgorithms().HostKeys)
+	for _, algo := range algorithms {
+		if !slices.Contains(supported, algo) {
+			return nil, fmt.Errorf("unsupported host key algorithm: %q", algo)
+		}
+	}
+	if len(algorithms) != 0 {
+		return algorithms, nil
+	}
+
+	types := knownHostKeyTypes(params, address)
+	for _, algo := range ssh.SupportedAlgorithms().HostKeys {
+		keyType := algo
+		if algo == ssh.KeyAlgoRSASHA256 || algo == ssh.KeyAlgoRSASHA512 {
+			keyType = ssh.KeyAlgoRSA
+		}
+		if slices.Contains(types, keyType) {
+			algorithms = append(algorithms, algo)
+		}
+	}
+	return algorithms, nil
+}
+
+// execHostKeyArgs translates the host key parameters into ssh(1) options
+// for the ssh transport.
+func execHostKeyArgs(params map[string]string) ([]string, error) {
+	var args []string
+
+	if params["host_key_fingerprint"] != "" {
+		return nil, fmt.Errorf("host_key_fingerprint requires the native transport")
+	}
+
+	if params["insecure_ignore_host_key"] == "true" {
+		if params["known_hosts"] != "" {
+			return nil, fmt.Errorf("insecure_ignore_host_key can not be combined with known_hosts")
+		}
+		args = append(args, "-o", "StrictHostKeyChecking=no")
+		// args = append(args, "-o", "UserKnownHostsFile=/dev/null") ?
+	}
+
+	if value := params["known_hosts"]; value != "" {
+		var quoted []string
+		for _, file := range splitList(value) {
+			quoted = append(quoted, fmt.Sprintf("%q", expandHome(file)))
+		}
+		args = append(args, "-o", "StrictHostKeyChecking=yes")
+		args = append(args, "-o", "UserKnownHostsFile="+strings.Join(quoted, " "))
+		args = append(args, "-o", "GlobalKnownHostsFile=/dev/null")
+	}
+
+	if value := params["host_key_algorithms"]; value != "" {
+		args = append(args, "-o", "HostKeyAlgorithms="+strings.Join(splitList(value), ","))
+	}
+
+	return args, nil
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/sftp"
+)
+
+// ServerLimits are the limits advertised with limits@openssh.com, 0 when
+// a limit is not set.
+type ServerLimits struct {
+	MaxPacketLength uint64
+	MaxReadLength   uint64
+	MaxWriteLength  uint64
+	MaxOpenHandles  uint64
+}
+
+// connLimits are what a server advertised when first connected to.
+type connLimits struct {
+	version uint32
+	exts    map[string]string
+	limits  ServerLimits
+}
+
+var serverLimitsCache sync.Map // map[string]*connLimits
+
+func (raw *rawSession) limits() (ServerLimits, error) {
+	var limits ServerLimits
+
+	reply, err := raw.extended("limits@openssh.com", "limits@openssh.com", nil)
+	if err != nil {
+		return limits, err
+	}
+
+	rd := packetReader(reply)
+	for _, field := range []*uint64{
+		&limits.MaxPacketLength,
+		&limits.MaxReadLength,
+		&limits.MaxWriteLength,
+		&limits.MaxOpenHandles,
+	} {
+		if *field, err = rd.uint64(); err != nil {
+			return limits, fmt.Errorf("limits@openssh.com: %w", err)
+		}
+	}
+
+	return limits, nil
+}
+
+// serverLimits queries the version, extensions and limits of the server
+// behind endpoint once, servers without limits@openssh.com are assumed to
+// have none.
+func serverLimits(endpoint *url.URL, params map[string]string) (*connLimits, error) {
+	key := "limits-" + nativeKey(endpoint, params)
+
+	mu := lockFor(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if v, ok := serverLimitsCache.Load(key); ok {
+		return v.(*connLimits), nil
+	}
+
+	raw, err := openRawSession(endpoint, params)
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	conn := &connLimits{version: raw.version, exts: raw.exts}
+	if _, ok := raw.exts["limits@openssh.com"]; ok {
+		if conn.limits, err = raw.limits(); err != nil {
+			return nil, err
+		}
+	}
+
+	serverLimitsCache.Store(key, conn)
+	return conn, nil
+}
+
+// clampPacket lowers the packet size to what the server accepts.  Servers
+// that do not advertise their limits only get the packets every server
+// has to accept: one capping reads lower than requested answers with short
+// reads, which concurrent reads take for the end of the file.
+func (conn *connLimits) clampPacket(maxPacket uint64) uint64 {
+	if _, ok := conn.exts["limits@openssh.com"]; !ok {
+		if maxPacket > defaultMaxPacket {
+			warnOnce("sftp: server does not advertise limits@openssh.com, max_packet lowered to %s", humanize.IBytes(defaultMaxPacket))
+		}
+		return min(maxPacket, defaultMaxPacket)
+	}
+
+	for _, limit := range []uint64{conn.limits.MaxReadLength, conn.limits.MaxWriteLength} {
+		if limit > 0 && limit < maxPacket {
+			maxPacket = limit
+		}
+	}
+	return maxPacket
+}
+
+// newHandles returns the semaphore bounding the handles a session opens,
+// nil when the server does not cap them.  The cap applies to each session
+// on its own.
+func (conn *connLimits) newHandles() chan struct{} {
+	if n := conn.limits.MaxOpenHandles; n > 0 {
+		return make(chan struct{}, n)
+	}
+	return nil
+}
+
+// acquireHandle waits for a handle of the session to be available and
+// returns the function releasing it.
+func (c *Client) acquireHandle() func() {
+	if c.handles == nil {
+		return func() {}
+	}
+
+	c.handles <- struct{}{}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-c.handles })
+	}
+}
+
+// File is an open remote file, holding one of the server handles until
+// it is closed.
+type File struct {
+	*sftp.File
+	release func()
+}
+
+func (f *File) Close() error {
+	defer f.release()
+	return f.File.Close()
+}
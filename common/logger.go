@@ -0,0 +1,36 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/kcontext"
+	"github.com/PlakarKorp/kloset/logging"
+)
+
+// In plugin mode stdout carries the gRPC stream, everything is logged to
+// stderr.
+var defaultLogger = logging.NewLogger(os.Stderr, os.Stderr)
+
+// Logger returns the logger of the kloset context, or one writing to
+// stderr when running out of process.
+func Logger(ctx context.Context) *logging.Logger {
+	if kctx, ok := ctx.(*kcontext.KContext); ok {
+		if logger := kctx.GetLogger(); logger != nil {
+			return logger
+		}
+	}
+	return defaultLogger
+}
+
+var warned sync.Map // map[string]struct{}
+
+// warnOnce logs a warning the first time it is issued by the process.
+func warnOnce(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if _, loaded := warned.LoadOrStore(msg, struct{}{}); !loaded {
+		defaultLogger.Warn("%s", msg)
+	}
+}
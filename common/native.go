@@ -0,0 +1,267 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const nativeDialTimeout = 30 * time.Second
+
+// native SSH connections, shared by all sessions to the same endpoint
+// much like the ControlMaster is for the ssh transport.
+var nativeConns sync.Map // map[string]*ssh.Client
+
+func nativeKey(endpoint *url.URL, params map[string]string) string {
+	sum := connKey(endpoint, params)
+	return fmt.Sprintf("native-%x", sum[:8])
+}
+
+func sshUsername(endpoint *url.URL, params map[string]string) (string, error) {
+	if endpoint.User != nil && params["username"] != "" {
+		return "", fmt.Errorf("can not use user@host syntax and username parameter")
+	} else if endpoint.User != nil {
+		return endpoint.User.Username(), nil
+	} else if params["username"] != "" {
+		return params["username"], nil
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("could not determine username: %w", err)
+	}
+	return u.Username, nil
+}
+
+func parseSigner(pem []byte, passphrase string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err == nil {
+		return signer, nil
+	}
+
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("private key is encrypted and no passphrase was given")
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+}
+
+// nativeSigners gathers the public key signers for the native transport:
+// explicit key material, the identity file, or the usual default key
+// files when neither is given.
+func nativeSigners(params map[string]string) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+
+	passphrase := params["identity_passphrase"]
+
+	if key := params["ssh_private_key"]; key != "" {
+		signer, err := parseSigner([]byte(key), passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+		signers = append(signers, signer)
+	}
+
+	if id := params["identity"]; id != "" {
+		data, err := os.ReadFile(id)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := parseSigner(data, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse identity %s: %w", id, err)
+		}
+		signers = append(signers, signer)
+	}
+
+	if len(signers) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			data, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+			if err != nil {
+				continue
+			}
+			// encrypted default keys are left to the agent
+			if signer, err := ssh.ParsePrivateKey(data); err == nil {
+				signers = append(signers, signer)
+			}
+		}
+	}
+
+	return signers, nil
+}
+
+func nativeAuth(params map[string]string) ([]ssh.AuthMethod, func(), error) {
+	var methods []ssh.AuthMethod
+	cleanup := func() {}
+
+	sock := params["ssh_auth_sock"]
+	if sock == "" {
+		sock = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			cleanup = func() { conn.Close() }
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	signers, err := nativeSigners(params)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if password := params["password"]; password != "" {
+		methods = append(methods, ssh.Password(password))
+		methods = append(methods, ssh.KeyboardInteractive(
+			func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range questions {
+					if echos[i] {
+						return nil, fmt.Errorf("unexpected keyboard-interactive prompt: %q", questions[i])
+					}
+					answers[i] = password
+				}
+				return answers, nil
+			}))
+	}
+
+	if len(methods) == 0 {
+		cleanup()
+		return nil, nil, fmt.Errorf("no authentication method available")
+	}
+
+	return methods, cleanup, nil
+}
+
+func dialNative(endpoint *url.URL, params map[string]string) (*ssh.Client, error) {
+	username, err := sshUsername(endpoint, params)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := nativeHostKeyCallback(params)
+	if err != nil {
+		return nil, err
+	}
+
+	port := endpoint.Port()
+	if port == "" {
+		port = "22"
+	}
+	address := net.JoinHostPort(endpoint.Hostname(), port)
+
+	hostKeyAlgorithms, err := nativeHostKeyAlgorithms(params, address)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, cleanup, err := nativeAuth(params)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	config := &ssh.ClientConfig{
+		User:              username,
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           nativeDialTimeout,
+	}
+
+	conn, err := ssh.Dial("tcp", address, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", endpoint.Host, err)
+	}
+	return conn, nil
+}
+
+// ensureNative returns the shared SSH connection for endpoint, dialing a
+// new one if there is none yet or if the previous one went away.
+func ensureNative(endpoint *url.URL, params map[string]string) (*ssh.Client, error) {
+	key := nativeKey(endpoint, params)
+
+	mu := lockFor(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if v, ok := nativeConns.Load(key); ok {
+		conn := v.(*ssh.Client)
+		if _, _, err := conn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			return conn, nil
+		}
+		conn.Close()
+		nativeConns.Delete(key)
+	}
+
+	conn, err := dialNative(endpoint, params)
+	if err != nil {
+		return nil, err
+	}
+	nativeConns.Store(key, conn)
+
+	return conn, nil
+}
+
+func nativePipe(endpoint *url.URL, params map[string]string) (io.Reader, io.WriteCloser, func() error, error) {
+	conn, err := ensureNative(endpoint, params)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, nil, nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, nil, err
+	}
+
+	return stdout, &sessionWriter{stdin, session}, func() error { return nil }, nil
+}
+
+// sessionWriter is the stdin of a session, closing it ends the session so
+// that its channel does not outlive the sftp client.
+type sessionWriter struct {
+	io.WriteCloser
+	session *ssh.Session
+}
+
+func (w *sessionWriter) Close() error {
+	err := w.WriteCloser.Close()
+	w.session.Close()
+	return err
+}
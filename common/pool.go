@@ -0,0 +1,83 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultMaxSessions = 4
+
+// Pool is a set of SFTP sessions to the same endpoint, all multiplexed
+// over the shared SSH connection, so that concurrent transfers are not
+// bottlenecked on a single channel.
+type Pool struct {
+	sessions []*poolSession
+}
+
+type poolSession struct {
+	client *Client
+	busy   atomic.Int64
+}
+
+func maxSessions(params map[string]string) (int, error) {
+	value, ok := params["max_sessions"]
+	if !ok || value == "" {
+		return defaultMaxSessions, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid max_sessions: %q", value)
+	}
+	return n, nil
+}
+
+// NewPool opens max_sessions SFTP sessions to endpoint.
+func NewPool(endpoint *url.URL, params map[string]string) (*Pool, error) {
+	n, err := maxSessions(params)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &Pool{}
+	for range n {
+		client, err := NewClient(endpoint, params)
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+		pool.sessions = append(pool.sessions, &poolSession{client: client})
+	}
+
+	return pool, nil
+}
+
+// Acquire returns the least busy session of the pool along with a
+// function to call once the caller is done with it.
+func (p *Pool) Acquire() (*Client, func()) {
+	best := p.sessions[0]
+	for _, session := range p.sessions[1:] {
+		if session.busy.Load() < best.busy.Load() {
+			best = session
+		}
+	}
+
+	best.busy.Add(1)
+
+	var once sync.Once
+	return best.client, func() {
+		once.Do(func() { best.busy.Add(-1) })
+	}
+}
+
+func (p *Pool) Close() error {
+	var errs []error
+	for _, session := range p.sessions {
+		errs = append(errs, session.client.Close())
+	}
+	return errors.Join(errs...)
+}
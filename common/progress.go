@@ -0,0 +1,195 @@
+package common
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PlakarKorp/kloset/logging"
+	"github.com/dustin/go-humanize"
+)
+
+const defaultProgressInterval = 5 * time.Second
+
+// Progress reports the progress of transfers, per object and in
+// aggregate, every interval.  Reports go to stderr, stdout carries the
+// gRPC stream in plugin mode.  A nil Progress reports nothing.
+type Progress struct {
+	logger   *logging.Logger
+	interval time.Duration
+
+	startOnce sync.Once
+	start     time.Time
+	total     atomic.Int64
+}
+
+func NewProgress(logger *logging.Logger) *Progress {
+	return &Progress{
+		logger:   logger,
+		interval: defaultProgressInterval,
+	}
+}
+
+// Transfer tracks the progress of a single object.
+type Transfer struct {
+	progress *Progress
+	op       string
+	name     string
+	size     int64 // -1 when unknown
+
+	start  time.Time
+	done   atomic.Int64
+	mu     sync.Mutex
+	last   time.Time
+	finish sync.Once
+}
+
+// Start begins tracking a transfer of size bytes, or -1 if unknown.
+func (p *Progress) Start(op, name string, size int64) *Transfer {
+	if p == nil {
+		return nil
+	}
+
+	now := time.Now()
+	p.startOnce.Do(func() { p.start = now })
+
+	return &Transfer{
+		progress: p,
+		op:       op,
+		name:     name,
+		size:     size,
+		start:    now,
+		last:     now,
+	}
+}
+
+func rate(n int64, elapsed time.Duration) int64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(n) / elapsed.Seconds())
+}
+
+func (t *Transfer) add(n int) {
+	if t == nil || n == 0 {
+		return
+	}
+	t.done.Add(int64(n))
+	t.progress.total.Add(int64(n))
+
+	now := time.Now()
+	t.mu.Lock()
+	if now.Sub(t.last) < t.progress.interval {
+		t.mu.Unlock()
+		return
+	}
+	t.last = now
+	t.mu.Unlock()
+
+	t.report(now)
+}
+
+func (t *Transfer) report(now time.Time) {
+	p := t.progress
+	done := t.done.Load()
+	bps := rate(done, now.Sub(t.start))
+
+	eta := "unknown"
+	if t.size >= 0 && bps > 0 {
+		eta = (time.Duration(float64(t.size-done)/float64(bps)) * time.Second).Round(time.Second).String()
+	}
+
+	size := "?"
+	if t.size >= 0 {
+		size = humanize.IBytes(uint64(t.size))
+	}
+
+	total := p.total.Load()
+	p.logger.Stderr("sftp: %s %s: %s/%s at %s/s, eta %s (all transfers: %s at %s/s)",
+		t.op, t.name, humanize.IBytes(uint64(done)), size, humanize.IBytes(uint64(bps)), eta,
+		humanize.IBytes(uint64(total)), humanize.IBytes(uint64(rate(total, now.Sub(p.start)))))
+}
+
+// Done reports the outcome of the transfer, only the first call counts.
+func (t *Transfer) Done(err error) {
+	if t == nil {
+		return
+	}
+	t.finish.Do(func() {
+		elapsed := time.Since(t.start)
+		done := t.done.Load()
+		if err != nil {
+			t.progress.logger.Stderr("sftp: %s %s: failed after %s: %v", t.op, t.name, humanize.IBytes(uint64(done)), err)
+			return
+		}
+		t.progress.logger.Stderr("sftp: %s %s: %s in %s at %s/s", t.op, t.name,
+			humanize.IBytes(uint64(done)), elapsed.Round(time.Millisecond), humanize.IBytes(uint64(rate(done, elapsed))))
+	})
+}
+
+type progressReader struct {
+	rd       io.Reader
+	transfer *Transfer
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.transfer.add(n)
+	return n, err
+}
+
+// progressReadSeeker keeps the reader seekable, bytes read again after a
+// rewind are not counted twice.
+type progressReadSeeker struct {
+	progressReader
+	pos int64
+}
+
+func (r *progressReadSeeker) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.pos += int64(n)
+	if r.pos > r.transfer.done.Load() {
+		r.transfer.add(int(r.pos - r.transfer.done.Load()))
+	}
+	return n, err
+}
+
+func (r *progressReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.rd.(io.Seeker).Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
+
+// Reader counts the bytes read from rd towards the transfer.
+func (t *Transfer) Reader(rd io.Reader) io.Reader {
+	if t == nil {
+		return rd
+	}
+	if _, ok := rd.(io.ReadSeeker); ok {
+		return &progressReadSeeker{progressReader: progressReader{rd, t}}
+	}
+	return &progressReader{rd, t}
+}
+
+type progressReadCloser struct {
+	progressReader
+	closer io.Closer
+}
+
+func (r *progressReadCloser) Close() error {
+	err := r.closer.Close()
+	r.transfer.Done(err)
+	return err
+}
+
+// ReadCloser counts the bytes read from rd towards the transfer, which is
+// done once rd is closed.
+func (t *Transfer) ReadCloser(rd io.ReadCloser) io.ReadCloser {
+	if t == nil {
+		return rd
+	}
+	return &progressReadCloser{progressReader{rd, t}, rd}
+}
@@ -15,13 +15,41 @@ import (
 	"github.com/pkg/sftp"
 )
 
+// connParams select how a connection authenticates and verifies the
+// server, a connection is only shared by configurations agreeing on all of
+// them so that none bypasses the host key checks of another.
+var connParams = []string{
+	"username",
+	"identity",
+	"identity_passphrase",
+	"ssh_private_key",
+	"ssh_auth_sock",
+	"password",
+	"known_hosts",
+	"host_key_fingerprint",
+	"host_key_algorithms",
+	"insecure_ignore_host_key",
+}
+
+// connKey hashes endpoint along with the connParams.
+func connKey(endpoint *url.URL, params map[string]string) [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%s", len(endpoint.String()), endpoint.String())
+	for _, name := range connParams {
+		fmt.Fprintf(h, "|%s=%d:%s", name, len(params[name]), params[name])
+	}
+
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
 func controlSock(endpoint *url.URL, params map[string]string) (string, error) {
 	if endpoint == nil {
 		return "", fmt.Errorf("nil endpoint")
 	}
 
-	key := endpoint.String() + "|" + params["username"] + "|" + params["identity"]
-	sum := sha256.Sum256([]byte(key))
+	sum := connKey(endpoint, params)
 	return filepath.Join(os.TempDir(), fmt.Sprintf("plakar-ssh-%x.sock", sum[:8])), nil
 }
 
@@ -88,10 +116,11 @@ func ensureMaster(endpoint *url.URL, params map[string]string) (string, error) {
 		// Non-interactive: fail fast instead of hanging on passphrase/host-key prompt
 		args = append(args, "-o", "BatchMode=yes")
 
-		if params["insecure_ignore_host_key"] == "true" {
-			args = append(args, "-o", "StrictHostKeyChecking=no")
-			// args = append(args, "-o", "UserKnownHostsFile=/dev/null") ?
+		hostKeyArgs, err := execHostKeyArgs(params)
+		if err != nil {
+			return nil, err
 		}
+		args = append(args, hostKeyArgs...)
 
 		if id := params["identity"]; id != "" {
 			args = append(args, "-i", id)
@@ -176,6 +205,23 @@ func ensureMaster(endpoint *url.URL, params map[string]string) (string, error) {
 	return sock, nil
 }
 
+// sftpPipe starts an sftp subsystem on endpoint using the transport
+// selected by the "transport" parameter and returns its stdout and stdin,
+// along with a function reporting errors the transport printed, if any.
+func sftpPipe(endpoint *url.URL, params map[string]string) (io.Reader, io.WriteCloser, func() error, error) {
+	switch params["transport"] {
+	case "", "ssh":
+		return execPipe(endpoint, params)
+	case "native":
+		return nativePipe(endpoint, params)
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported transport: %q", params["transport"])
+	}
+}
+
+// Connect opens an SFTP session to endpoint: "ssh" (the default) execs the
+// system ssh binary over a shared ControlMaster, "native" uses an
+// in-process client.
 func Connect(endpoint *url.URL, params map[string]string) (*sftp.Client, error) {
 	if endpoint == nil {
 		return nil, fmt.Errorf("nil endpoint")
@@ -186,19 +232,44 @@ func Connect(endpoint *url.URL, params map[string]string) (*sftp.Client, error)
 		return nil, fmt.Errorf("missing hostname in endpoint: %q", endpoint.String())
 	}
 
-	// ensure the master exists (idempotent) and get the control socket path.
-	sock, err := ensureMaster(endpoint, params)
+	conn, err := serverLimits(endpoint, params)
 	if err != nil {
 		return nil, err
 	}
 
+	opts, err := clientOptions(params, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, stdin, sshErr, err := sftpPipe(endpoint, params)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClientPipe(stdout, stdin, opts...)
+	if err != nil {
+		if err := sshErr(); err != nil {
+			return nil, err
+		}
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// execArgs returns the ssh(1) arguments to reach endpoint through the
+// master listening on sock.
+func execArgs(endpoint *url.URL, params map[string]string, sock string) ([]string, error) {
 	var args []string
 
 	args = append(args, "-o", "BatchMode=yes")
 
-	if params["insecure_ignore_host_key"] == "true" {
-		args = append(args, "-o", "StrictHostKeyChecking=no")
+	hostKeyArgs, err := execHostKeyArgs(params)
+	if err != nil {
+		return nil, err
 	}
+	args = append(args, hostKeyArgs...)
 
 	if id := params["identity"]; id != "" {
 		args = append(args, "-i", id)
@@ -219,16 +290,32 @@ func Connect(endpoint *url.URL, params map[string]string) (*sftp.Client, error)
 
 	// reuse the master
 	args = append(args, "-S", sock)
-	args = append(args, host)
+	args = append(args, endpoint.Hostname())
+
+	return args, nil
+}
+
+func execPipe(endpoint *url.URL, params map[string]string) (io.Reader, io.WriteCloser, func() error, error) {
+	// ensure the master exists (idempotent) and get the control socket path.
+	sock, err := ensureMaster(endpoint, params)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	args, err := execArgs(endpoint, params, sock)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 	args = append(args, "-s", "sftp")
 
 	cmd := exec.Command("ssh", args...)
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
+	var mu sync.Mutex
 	var sshErr error
 	go func() {
 		sc := bufio.NewScanner(stderr)
@@ -237,33 +324,31 @@ func Connect(endpoint *url.URL, params map[string]string) (*sftp.Client, error)
 			if strings.HasPrefix(line, "Warning:") {
 				continue
 			}
+			mu.Lock()
 			sshErr = fmt.Errorf("ssh command error: %q", line)
+			mu.Unlock()
 		}
 	}()
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	if err := cmd.Start(); err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	// reap process
 	go func() { _ = cmd.Wait() }()
 
-	client, err := sftp.NewClientPipe(stdout, stdin)
-	if err != nil {
-		if sshErr != nil {
-			return nil, sshErr
-		}
-		return nil, err
-	}
-
-	return client, nil
+	return stdout, stdin, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return sshErr
+	}, nil
 }
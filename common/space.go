@@ -0,0 +1,123 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/sftp"
+)
+
+// LowSpaceError is returned when the remote filesystem has less free
+// space than configured with min_free_bytes or min_free_percent.
+type LowSpaceError struct {
+	Path  string
+	Free  uint64
+	Total uint64
+}
+
+func (e *LowSpaceError) Error() string {
+	return fmt.Sprintf("not enough free space on %s: %s free of %s",
+		e.Path, humanize.IBytes(e.Free), humanize.IBytes(e.Total))
+}
+
+// SpaceCheck holds the free space thresholds checked before starting to
+// write to the remote host.
+type SpaceCheck struct {
+	MinFreeBytes   uint64
+	MinFreePercent float64
+	WarnOnly       bool
+}
+
+// ParseSpaceCheck returns the thresholds configured in params, or nil if
+// there are none.
+func ParseSpaceCheck(params map[string]string) (*SpaceCheck, error) {
+	var check SpaceCheck
+
+	if value := params["min_free_bytes"]; value != "" {
+		n, err := humanize.ParseBytes(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid min_free_bytes: %q", value)
+		}
+		check.MinFreeBytes = n
+	}
+
+	if value := params["min_free_percent"]; value != "" {
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || n < 0 || n > 100 {
+			return nil, fmt.Errorf("invalid min_free_percent: %q", value)
+		}
+		check.MinFreePercent = n
+	}
+
+	switch params["min_free_action"] {
+	case "", "fail":
+	case "warn":
+		check.WarnOnly = true
+	default:
+		return nil, fmt.Errorf("invalid min_free_action: %q", params["min_free_action"])
+	}
+
+	if check.MinFreeBytes == 0 && check.MinFreePercent == 0 {
+		return nil, nil
+	}
+	return &check, nil
+}
+
+// statVFS queries the filesystem holding p, or its closest existing
+// parent since restore targets may not have been created yet.
+func statVFS(client *Client, p string) (*sftp.StatVFS, error) {
+	for {
+		stat, err := client.StatVFS(p)
+		if err == nil || p == "/" || p == "." {
+			return stat, err
+		}
+		p = path.Dir(p)
+	}
+}
+
+// freeSpace returns the space available to the user and the size of the
+// filesystem holding p.
+func freeSpace(client *Client, p string) (free, total uint64, err error) {
+	stat, err := statVFS(client, p)
+	if err != nil {
+		return 0, 0, err
+	}
+	return stat.Bavail * stat.Frsize, stat.Blocks * stat.Frsize, nil
+}
+
+// Check verifies that the filesystem holding p has enough free space.
+// Failures are only logged when the check is configured to warn, or when
+// the server does not support the statvfs@openssh.com extension.
+func (check *SpaceCheck) Check(ctx context.Context, client *Client, p string) error {
+	if check == nil {
+		return nil
+	}
+
+	if _, ok := client.HasExtension("statvfs@openssh.com"); !ok {
+		Logger(ctx).Warn("sftp: %s: can not check free space, server lacks statvfs@openssh.com", p)
+		return nil
+	}
+
+	free, total, err := freeSpace(client, p)
+	if err != nil {
+		return err
+	}
+
+	low := free < check.MinFreeBytes
+	if total > 0 && float64(free)*100/float64(total) < check.MinFreePercent {
+		low = true
+	}
+	if !low {
+		return nil
+	}
+
+	err = &LowSpaceError{Path: p, Free: free, Total: total}
+	if check.WarnOnly {
+		Logger(ctx).Warn("sftp: %v", err)
+		return nil
+	}
+	return err
+}
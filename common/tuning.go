@@ -0,0 +1,91 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/sftp"
+)
+
+const (
+	// the payload size every server has to accept, and the largest one
+	// that keeps a write request, headers included, within the 256KiB
+	// messages OpenSSH accepts
+	defaultMaxPacket = 32 * 1024
+	maxMaxPacket     = 255 * 1024
+
+	defaultMaxConcurrentRequests = 64
+)
+
+func parsePositive(params map[string]string, key string, def int) (int, error) {
+	value := params[key]
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s: %q", key, value)
+	}
+	return n, nil
+}
+
+func parseBool(params map[string]string, key string, def bool) (bool, error) {
+	value := params[key]
+	if value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %q", key, value)
+	}
+	return b, nil
+}
+
+// clientOptions translates the tuning parameters into pkg/sftp options:
+//
+//   - max_packet: payload size of read and write requests (default 32KiB,
+//     at most 255KiB), lowered to the limits the server advertises, or to
+//     32KiB if it advertises none
+//   - max_concurrent_requests: requests in flight per file (default 64)
+//   - concurrent_reads: read files with concurrent requests (default true)
+//   - concurrent_writes: write files with concurrent requests (default false)
+func clientOptions(params map[string]string, conn *connLimits) ([]sftp.ClientOption, error) {
+	maxPacket := uint64(defaultMaxPacket)
+	if value := params["max_packet"]; value != "" {
+		n, err := humanize.ParseBytes(value)
+		if err != nil || n < 512 || n > maxMaxPacket {
+			return nil, fmt.Errorf("invalid max_packet: %q, must be between 512B and 255KiB", value)
+		}
+		maxPacket = n
+	}
+
+	requests, err := parsePositive(params, "max_concurrent_requests", defaultMaxConcurrentRequests)
+	if err != nil {
+		return nil, err
+	}
+
+	reads, err := parseBool(params, "concurrent_reads", true)
+	if err != nil {
+		return nil, err
+	}
+
+	writes, err := parseBool(params, "concurrent_writes", false)
+	if err != nil {
+		return nil, err
+	}
+
+	return []sftp.ClientOption{
+		sftp.MaxPacketUnchecked(int(conn.clampPacket(maxPacket))),
+		sftp.MaxConcurrentRequestsPerFile(requests),
+		sftp.UseConcurrentReads(reads),
+		sftp.UseConcurrentWrites(writes),
+	}, nil
+}
+
+// WriteConcurrency returns the number of concurrent requests used to
+// upload a file, from write_concurrency.  0 lets pkg/sftp pick
+// max_concurrent_requests.
+func WriteConcurrency(params map[string]string) (int, error) {
+	return parsePositive(params, "write_concurrency", 0)
+}
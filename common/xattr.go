@@ -0,0 +1,138 @@
+package common
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Xattr is an extended attribute.  POSIX ACLs are the system.posix_acl_access
+// and system.posix_acl_default attributes.
+type Xattr struct {
+	Name  string
+	Value []byte
+}
+
+// unquoteAttr reverses the octal escapes getfattr(1) applies to paths and
+// names.
+func unquoteAttr(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		if s[i] == '\\' && i+1 < len(s) && s[i+1] == '\\' {
+			b.WriteByte('\\')
+			i++
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func decodeAttrValue(s string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(s, "0s"):
+		return base64.StdEncoding.DecodeString(s[2:])
+	case strings.HasPrefix(s, "0x"):
+		return hex.DecodeString(s[2:])
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		return []byte(unquoteAttr(s[1 : len(s)-1])), nil
+	default:
+		return []byte(s), nil
+	}
+}
+
+// parseXattrDump reads the output of getfattr --dump, keyed by path.
+func parseXattrDump(rd io.Reader) (map[string][]Xattr, error) {
+	attrs := make(map[string][]Xattr)
+
+	sc := bufio.NewScanner(rd)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var current string
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			current = ""
+		case strings.HasPrefix(line, "# file: "):
+			current = path.Clean(unquoteAttr(strings.TrimPrefix(line, "# file: ")))
+		case strings.HasPrefix(line, "#") || current == "":
+		default:
+			name, value, _ := strings.Cut(line, "=")
+			data, err := decodeAttrValue(value)
+			if err != nil {
+				return attrs, fmt.Errorf("invalid value for %s on %s: %w", name, current, err)
+			}
+			attrs[current] = append(attrs[current], Xattr{Name: unquoteAttr(name), Value: data})
+		}
+	}
+
+	return attrs, sc.Err()
+}
+
+// collectLines reads rd to completion in the background, the lines are
+// returned once wait is called.
+func collectLines(rd io.Reader) (wait func() []string) {
+	var lines []string
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sc := bufio.NewScanner(rd)
+		for sc.Scan() {
+			lines = append(lines, sc.Text())
+		}
+	}()
+	return func() []string {
+		wg.Wait()
+		return lines
+	}
+}
+
+// GetXattrs returns the extended attributes of the tree at root, keyed by
+// path, with a single getfattr(1) run on the server.  Symlinks are not
+// followed.  Entries that could not be read are left out.
+func (c *Client) GetXattrs(root string) (map[string][]Xattr, error) {
+	cmd, err := c.Exec("env LC_ALL=C getfattr -R -P -h -d -m - -e base64 --absolute-names -- " + ShellQuote(root))
+	if err != nil {
+		return nil, fmt.Errorf("getfattr: %w", err)
+	}
+
+	stderr := collectLines(cmd.Stderr)
+	attrs, parseErr := parseXattrDump(cmd.Stdout)
+	if parseErr != nil {
+		cmd.Kill()
+		io.Copy(io.Discard, cmd.Stdout)
+	}
+	diagnostics := stderr()
+	err = cmd.Wait()
+
+	if parseErr != nil {
+		return nil, fmt.Errorf("getfattr: %w", parseErr)
+	}
+	// getfattr exits with 1 when some entries could not be read
+	if err != nil && len(attrs) == 0 {
+		if len(diagnostics) > 0 {
+			return nil, fmt.Errorf("getfattr: %s", diagnostics[0])
+		}
+		return nil, fmt.Errorf("getfattr: %w", err)
+	}
+	return attrs, nil
+}
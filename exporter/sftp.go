@@ -24,6 +24,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"sync"
 
 	plakarsftp "github.com/PlakarKorp/integration-sftp/common"
@@ -31,7 +32,6 @@ import (
 	"github.com/PlakarKorp/kloset/connectors/exporter"
 	"github.com/PlakarKorp/kloset/location"
 	"github.com/PlakarKorp/kloset/objects"
-	"github.com/pkg/sftp"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/singleflight"
 )
@@ -43,8 +43,13 @@ func init() {
 type Exporter struct {
 	opts *connectors.Options
 
-	client   *sftp.Client
-	endpoint *url.URL
+	client     *plakarsftp.Client
+	endpoint   *url.URL
+	spaceCheck *plakarsftp.SpaceCheck
+	upload     *plakarsftp.Limiter
+
+	writeConcurrency int
+	diagnostics      bool // Ping probes writes as Diagnostics does
 
 	hlCreate singleflight.Group // key -> ensures canonical exists, returns canonical abs path
 	hlCanon  sync.Map           // key -> canonical abs path string
@@ -83,15 +88,47 @@ func NewExporter(ctx context.Context, opt *connectors.Options, name string, conf
 		parsed.Host = fmt.Sprintf("%s:%s", parsed.Host, port)
 	}
 
-	client, err := plakarsftp.Connect(parsed, config)
+	spaceCheck, err := plakarsftp.ParseSpaceCheck(config)
+	if err != nil {
+		return nil, err
+	}
+
+	upload, _, err := plakarsftp.ParseLimits(config)
+	if err != nil {
+		return nil, err
+	}
+
+	writeConcurrency, err := plakarsftp.WriteConcurrency(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var diagnostics bool
+	if value, ok := config["diagnostics"]; ok {
+		if diagnostics, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid diagnostics: %q", value)
+		}
+	}
+
+	client, err := plakarsftp.NewClient(parsed, config)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := spaceCheck.Check(ctx, client, parsed.Path); err != nil {
+		client.Close()
+		return nil, err
+	}
+
 	return &Exporter{
-		opts:     opt,
-		endpoint: parsed,
-		client:   client,
+		opts:       opt,
+		endpoint:   parsed,
+		client:     client,
+		spaceCheck: spaceCheck,
+		upload:     upload,
+
+		writeConcurrency: writeConcurrency,
+		diagnostics:      diagnostics,
 	}, nil
 }
 
@@ -100,9 +137,22 @@ func (p *Exporter) Origin() string        { return p.endpoint.Host }
 func (p *Exporter) Type() string          { return "sftp" }
 func (p *Exporter) Flags() location.Flags { return 0 }
 
+// Ping checks the target without writing to it, unless the diagnostics
+// option asks for the write probe of Diagnostics.
 func (p *Exporter) Ping(ctx context.Context) error {
-	_, err := p.client.Lstat(p.endpoint.Path)
-	return err
+	d, err := plakarsftp.Diagnose(ctx, p.client, p.endpoint.Path, p.diagnostics)
+	if err != nil {
+		return err
+	}
+	d.Log(ctx)
+	return p.spaceCheck.Check(ctx, p.client, p.endpoint.Path)
+}
+
+// Diagnostics reports what the server supports, its latency and
+// throughput, and whether files can be written, renamed and deleted in
+// the target directory.
+func (p *Exporter) Diagnostics(ctx context.Context) (*plakarsftp.Diagnostics, error) {
+	return plakarsftp.Diagnose(ctx, p.client, p.endpoint.Path, true)
 }
 
 func (p *Exporter) Close(ctx context.Context) error {
@@ -250,7 +300,13 @@ func (p *Exporter) writeAtomic(record *connectors.Record, pathname string) error
 		}
 	}()
 
-	if _, err := io.Copy(tmp, record.Reader); err != nil {
+	rd := p.upload.Reader(record.Reader)
+	if p.writeConcurrency > 0 {
+		_, err = tmp.ReadFromWithConcurrency(rd, p.writeConcurrency)
+	} else {
+		_, err = io.Copy(tmp, rd)
+	}
+	if err != nil {
 		tmp.Close()
 		return fmt.Errorf("could not write")
 	}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2025 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package importer
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	plakarsftp "github.com/PlakarKorp/integration-sftp/common"
+)
+
+// idNames maps the uids and gids of the server to user and group names.
+type idNames struct {
+	users  map[uint64]string
+	groups map[uint64]string
+}
+
+// parseIDFile reads a passwd(5) or group(5) file, where the name and the
+// id are the first and third fields.  The first name of an id wins, like
+// getpwuid(3) does.
+func parseIDFile(rd io.Reader) map[uint64]string {
+	names := make(map[uint64]string)
+
+	sc := bufio.NewScanner(rd)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 4)
+		if len(fields) < 3 || fields[0] == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		if _, ok := names[id]; !ok {
+			names[id] = fields[0]
+		}
+	}
+
+	return names
+}
+
+func readIDFile(client *plakarsftp.Client, p string) map[uint64]string {
+	fp, err := client.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer fp.Close()
+
+	return parseIDFile(fp)
+}
+
+// loadIDNames reads /etc/passwd and /etc/group from the server.  Either
+// may be missing, as in an sftp-only chroot, leaving the ids unnamed.
+func loadIDNames(client *plakarsftp.Client) *idNames {
+	return &idNames{
+		users:  readIDFile(client, "/etc/passwd"),
+		groups: readIDFile(client, "/etc/group"),
+	}
+}
+
+func (imp *Importer) lookupIDs(uid, gid uint64) (string, string) {
+	if imp.ids == nil {
+		return "", ""
+	}
+	return imp.ids.users[uid], imp.ids.groups[gid]
+}
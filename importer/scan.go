@@ -0,0 +1,276 @@
+/*
+ * Copyright (c) 2025 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package importer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	plakarsftp "github.com/PlakarKorp/integration-sftp/common"
+)
+
+// ErrExecUnavailable is returned by ExecWalk when the server listed
+// nothing, because it does not allow commands or lacks GNU find.
+var ErrExecUnavailable = errors.New("remote find unavailable")
+
+// path, type, permissions, size, mtime, device, inode, uid, gid, links and
+// symlink target, each terminated by a NUL
+const (
+	scanFormat = `%p\0%y\0%m\0%s\0%T@\0%D\0%i\0%U\0%G\0%n\0%l\0`
+	scanFields = 11
+)
+
+// scanStat is what find(1) reports beyond os.FileInfo, the Sys() of the
+// entries listed by ExecWalk.
+type scanStat struct {
+	Dev    uint64
+	Ino    uint64
+	Uid    uint64
+	Gid    uint64
+	Nlink  uint64
+	Target string // symlink target
+}
+
+type scanInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	sys     *scanStat
+}
+
+func (fi *scanInfo) Name() string       { return fi.name }
+func (fi *scanInfo) Size() int64        { return fi.size }
+func (fi *scanInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *scanInfo) ModTime() time.Time { return fi.modTime }
+func (fi *scanInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *scanInfo) Sys() any           { return fi.sys }
+
+var scanTypes = map[string]os.FileMode{
+	"f": 0,
+	"d": os.ModeDir,
+	"l": os.ModeSymlink,
+	"b": os.ModeDevice,
+	"c": os.ModeDevice | os.ModeCharDevice,
+	"p": os.ModeNamedPipe,
+	"s": os.ModeSocket,
+}
+
+func parseScanEntry(fields []string) (string, *scanInfo, error) {
+	p := path.Clean(fields[0])
+
+	mode, ok := scanTypes[fields[1]]
+	if !ok {
+		mode = os.ModeIrregular
+	}
+
+	perm, err := strconv.ParseUint(fields[2], 8, 32)
+	if err != nil {
+		return p, nil, fmt.Errorf("invalid mode %q", fields[2])
+	}
+	mode |= os.FileMode(perm) & os.ModePerm
+	if perm&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if perm&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if perm&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+
+	size, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return p, nil, fmt.Errorf("invalid size %q", fields[3])
+	}
+
+	// sftp only has second precision, truncate to record the same mtime in
+	// both scan modes
+	secs, _, _ := strings.Cut(fields[4], ".")
+	mtime, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return p, nil, fmt.Errorf("invalid mtime %q", fields[4])
+	}
+
+	sys := &scanStat{Target: fields[10]}
+	for i, field := range []*uint64{&sys.Dev, &sys.Ino, &sys.Uid, &sys.Gid, &sys.Nlink} {
+		if *field, err = strconv.ParseUint(fields[5+i], 10, 64); err != nil {
+			return p, nil, fmt.Errorf("invalid stat field %q", fields[5+i])
+		}
+	}
+
+	return p, &scanInfo{
+		name:    path.Base(p),
+		size:    size,
+		mode:    mode,
+		modTime: time.Unix(mtime, 0),
+		sys:     sys,
+	}, nil
+}
+
+// parseScanError splits a find(1) diagnostic in the C locale, such as
+// "find: '/root': Permission denied".
+func parseScanError(root, line string) (string, error) {
+	line = strings.TrimPrefix(line, "find: ")
+	if strings.HasPrefix(line, "'") {
+		if i := strings.LastIndex(line, "': "); i > 0 {
+			return line[1:i], errors.New(line[i+3:])
+		}
+	}
+	return root, errors.New(line)
+}
+
+func within(p, dir string) bool {
+	return strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// ExecWalk is SFTPWalk listing the tree with a single find(1) on the
+// server, in the order find returns it.  Skipped directories are still
+// traversed remotely, only their entries are dropped.  With xdev, the walk
+// stays on the filesystem of remotePath.  If nothing could be listed,
+// ErrExecUnavailable is returned before walkFn is ever called.
+func ExecWalk(client *plakarsftp.Client, remotePath string, xdev bool, walkFn func(path string, info os.FileInfo, err error) error) error {
+	root := path.Clean(remotePath)
+
+	command := "env LC_ALL=C find " + plakarsftp.ShellQuote(root)
+	if xdev {
+		command += " -xdev"
+	}
+	command += " -printf " + plakarsftp.ShellQuote(scanFormat)
+
+	cmd, err := client.Exec(command)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrExecUnavailable, err)
+	}
+
+	var diagnostics []string
+	var stderrDone sync.WaitGroup
+	stderrDone.Add(1)
+	go func() {
+		defer stderrDone.Done()
+		sc := bufio.NewScanner(cmd.Stderr)
+		for sc.Scan() {
+			diagnostics = append(diagnostics, sc.Text())
+		}
+	}()
+
+	var (
+		rd      = bufio.NewReaderSize(cmd.Stdout, 64*1024)
+		fields  = make([]string, scanFields)
+		listed  bool
+		skipped []string
+		rootDev uint64
+		walkErr error
+	)
+
+scan:
+	for {
+		for i := range fields {
+			field, err := rd.ReadString(0)
+			if err != nil {
+				if err != io.EOF || i != 0 || field != "" {
+					walkErr = fmt.Errorf("find: truncated output")
+				}
+				break scan
+			}
+			fields[i] = field[:len(field)-1]
+		}
+
+		p, info, err := parseScanEntry(fields)
+		if err != nil {
+			walkErr = fmt.Errorf("find: %s: %w", p, err)
+			break
+		}
+
+		if !listed {
+			listed = true
+			rootDev = info.sys.Dev
+		}
+
+		if n := len(skipped); n > 0 && within(p, skipped[n-1]) {
+			continue
+		}
+
+		// -xdev still lists the mount points, SFTPWalk skips them
+		if xdev && info.IsDir() && info.sys.Dev != rootDev {
+			skipped = append(skipped, p)
+			continue
+		}
+
+		if err := walkFn(p, info, nil); err != nil {
+			if err == SkipDir {
+				if info.IsDir() {
+					skipped = append(skipped, p)
+				}
+				continue
+			}
+			walkErr = err
+			break
+		}
+	}
+
+	if walkErr != nil {
+		cmd.Kill()
+	}
+	stderrDone.Wait()
+	err = cmd.Wait()
+
+	if !listed && walkErr == nil {
+		if len(diagnostics) > 0 {
+			return fmt.Errorf("%w: %s", ErrExecUnavailable, diagnostics[0])
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrExecUnavailable, err)
+		}
+		return ErrExecUnavailable
+	}
+
+	if walkErr == nil {
+	report:
+		for _, line := range diagnostics {
+			p, diag := parseScanError(root, line)
+			for _, dir := range skipped {
+				if p == dir || within(p, dir) {
+					continue report
+				}
+			}
+			if err := walkFn(p, nil, diag); err != nil && err != SkipDir {
+				walkErr = err
+				break
+			}
+		}
+
+		// find exits with 1 when some entries could not be listed,
+		// which were reported above
+		if err != nil && !(plakarsftp.ExitStatus(err) == 1 && len(diagnostics) > 0) {
+			walkErr = fmt.Errorf("find: %w", err)
+		}
+	}
+
+	if walkErr == SkipDir || walkErr == SkipAll {
+		walkErr = nil
+	}
+	return walkErr
+}
@@ -30,7 +30,6 @@ import (
 	"github.com/PlakarKorp/kloset/connectors/importer"
 	"github.com/PlakarKorp/kloset/exclude"
 	"github.com/PlakarKorp/kloset/location"
-	"github.com/pkg/sftp"
 )
 
 func init() {
@@ -40,14 +39,23 @@ func init() {
 type Importer struct {
 	opts *connectors.Options
 
-	client   *sftp.Client
+	client   *plakarsftp.Client
 	endpoint *url.URL
+	download *plakarsftp.Limiter
 
 	rootDir   string
 	realpath  string
 	excludes  *exclude.RuleSet
 	nocrossfs bool
 	devno     uint64
+
+	sortedWalk bool
+	execScan   bool
+
+	ids *idNames
+
+	xattrs bool
+	attrs  map[string][]plakarsftp.Xattr
 }
 
 func NewImporter(appCtx context.Context, opts *connectors.Options, name string, config map[string]string) (importer.Importer, error) {
@@ -83,12 +91,40 @@ func NewImporter(appCtx context.Context, opts *connectors.Options, name string,
 
 	nocrossfs, _ := strconv.ParseBool(config["dont_traverse_fs"])
 
+	var sortedWalk bool
+	if value, ok := config["sorted_walk"]; ok {
+		if sortedWalk, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid sorted_walk: %q", value)
+		}
+	}
+
+	var execScan bool
+	switch value := config["scan"]; value {
+	case "", "sftp":
+	case "exec":
+		execScan = true
+	default:
+		return nil, fmt.Errorf("invalid scan: %q", value)
+	}
+
+	var xattrs bool
+	if value, ok := config["xattrs"]; ok {
+		if xattrs, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid xattrs: %q", value)
+		}
+	}
+
 	excludes := exclude.NewRuleSet()
 	if err := excludes.AddRulesFromArray(opts.Excludes); err != nil {
 		return nil, fmt.Errorf("failed to setup exclude rules: %w", err)
 	}
 
-	client, err := plakarsftp.Connect(parsed, config)
+	_, download, err := plakarsftp.ParseLimits(config)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := plakarsftp.NewClient(parsed, config)
 	if err != nil {
 		return nil, err
 	}
@@ -97,9 +133,14 @@ func NewImporter(appCtx context.Context, opts *connectors.Options, name string,
 		opts:      opts,
 		endpoint:  parsed,
 		client:    client,
+		download:  download,
 		nocrossfs: nocrossfs,
 		rootDir:   rootDir,
 		excludes:  excludes,
+
+		sortedWalk: sortedWalk,
+		execScan:   execScan,
+		xattrs:     xattrs,
 	}
 
 	realpath, devno, err := imp.realpathFollow(rootDir)
@@ -130,6 +171,14 @@ func (imp *Importer) Flags() location.Flags {
 
 func (imp *Importer) Import(ctx context.Context, records chan<- *connectors.Record, results <-chan *connectors.Result) error {
 	defer close(records)
+	imp.ids = loadIDNames(imp.client)
+	if imp.xattrs {
+		attrs, err := imp.client.GetXattrs(imp.rootDir)
+		if err != nil {
+			plakarsftp.Logger(ctx).Warn("sftp: %s: extended attributes not captured: %v", imp.endpoint.Host, err)
+		}
+		imp.attrs = attrs
+	}
 	return imp.walkDir_walker(ctx, records, imp.opts.MaxConcurrency)
 }
 
@@ -147,9 +196,9 @@ func (imp *Importer) walkDir_walker(ctx context.Context, records chan<- *connect
 		imp.walkDir_addPrefixDirectories(imp.Root(), records)
 	}
 
-	err := SFTPWalk(imp.client, imp.rootDir, func(path string, info os.FileInfo, err error) error {
+	walkFn := func(path string, info os.FileInfo, err error) error {
 		if ctx.Err() != nil {
-			return err
+			return SkipAll
 		}
 
 		if err != nil {
@@ -172,7 +221,16 @@ func (imp *Importer) walkDir_walker(ctx context.Context, records chan<- *connect
 
 		jobs <- file{path: path, info: info}
 		return nil
-	})
+	}
+
+	var err error
+	if imp.execScan {
+		// no fallback to SFTPWalk, which does not report the device, inode
+		// and link count, every file would look modified to kloset
+		err = ExecWalk(imp.client, imp.rootDir, imp.nocrossfs, walkFn)
+	} else {
+		err = SFTPWalkParallel(imp.client, imp.rootDir, numWorkers, imp.sortedWalk, walkFn)
+	}
 
 	close(jobs)
 	wg.Wait()
@@ -205,8 +263,18 @@ func (imp *Importer) realpathFollow(target string) (resolved string, dev uint64,
 }
 
 func (p *Importer) Ping(ctx context.Context) error {
-	_, err := p.client.Lstat(p.rootDir)
-	return err
+	d, err := p.Diagnostics(ctx)
+	if err != nil {
+		return err
+	}
+	d.Log(ctx)
+	return nil
+}
+
+// Diagnostics reports what the server supports and how fast it answers,
+// the source is never written to.
+func (p *Importer) Diagnostics(ctx context.Context) (*plakarsftp.Diagnostics, error) {
+	return plakarsftp.Diagnose(ctx, p.client, p.rootDir, false)
 }
 
 func (p *Importer) Close(ctx context.Context) error {
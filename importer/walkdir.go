@@ -17,12 +17,17 @@
 package importer
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"os"
 	"path"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 
+	plakarsftp "github.com/PlakarKorp/integration-sftp/common"
 	"github.com/PlakarKorp/kloset/connectors"
 	"github.com/PlakarKorp/kloset/objects"
 	"github.com/pkg/sftp"
@@ -38,6 +43,24 @@ var (
 	SkipAll = errors.New("skip everything and stop the walk")
 )
 
+// fileInfo converts info, filling in the ownership sftp reports and what
+// an exec scan knows beyond os.FileInfo.
+func fileInfo(info os.FileInfo) objects.FileInfo {
+	fileinfo := objects.FileInfoFromStat(info)
+	switch sys := info.Sys().(type) {
+	case *sftp.FileStat:
+		fileinfo.Luid = uint64(sys.UID)
+		fileinfo.Lgid = uint64(sys.GID)
+	case *scanStat:
+		fileinfo.Ldev = sys.Dev
+		fileinfo.Lino = sys.Ino
+		fileinfo.Luid = sys.Uid
+		fileinfo.Lgid = sys.Gid
+		fileinfo.Lnlink = uint16(sys.Nlink)
+	}
+	return fileinfo
+}
+
 // Worker pool to handle file scanning in parallel
 func (imp *Importer) walkDir_worker(jobs <-chan file, records chan<- *connectors.Record, wg *sync.WaitGroup) {
 	defer wg.Done()
@@ -48,12 +71,14 @@ func (imp *Importer) walkDir_worker(jobs <-chan file, records chan<- *connectors
 			imp.rootDir = path.Dir(imp.Root())
 		}
 
-		fileinfo := objects.FileInfoFromStat(p.info)
-		//fileinfo.Lusername, fileinfo.Lgroupname = imp.lookupIDs(fileinfo.Uid(), fileinfo.Gid())
+		fileinfo := fileInfo(p.info)
+		fileinfo.Lusername, fileinfo.Lgroupname = imp.lookupIDs(fileinfo.Uid(), fileinfo.Gid())
 
 		var originFile string
 		var err error
-		if p.info.Mode()&os.ModeSymlink != 0 {
+		if sys, ok := p.info.Sys().(*scanStat); ok && p.info.Mode()&os.ModeSymlink != 0 {
+			originFile = sys.Target
+		} else if p.info.Mode()&os.ModeSymlink != 0 {
 			originFile, err = imp.client.ReadLink(p.path)
 			if err != nil {
 				records <- connectors.NewError(p.path, err)
@@ -63,10 +88,29 @@ func (imp *Importer) walkDir_worker(jobs <-chan file, records chan<- *connectors
 
 		entrypath := p.path
 
-		records <- connectors.NewRecord(entrypath, originFile, fileinfo, []string{},
+		// the reader is lazy: files found unchanged against the previous
+		// snapshot are never opened
+		attrs := imp.attrs[p.path]
+		names := make([]string, 0, len(attrs))
+		for _, attr := range attrs {
+			names = append(names, attr.Name)
+		}
+
+		records <- connectors.NewRecord(entrypath, originFile, fileinfo, names,
 			func() (io.ReadCloser, error) {
-				return imp.client.Open(p.path)
+				fp, err := imp.client.Open(p.path)
+				if err != nil {
+					return nil, err
+				}
+				return imp.download.ReadCloser(fp), nil
 			})
+
+		for _, attr := range attrs {
+			records <- connectors.NewXattr(entrypath, attr.Name, objects.AttributeExtended,
+				func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader(attr.Value)), nil
+				})
+		}
 	}
 }
 
@@ -82,7 +126,8 @@ func (imp *Importer) walkDir_addPrefixDirectories(root string, records chan<- *c
 				Lmode: os.ModeDir | 0755,
 			}
 		} else {
-			finfo = objects.FileInfoFromStat(sb)
+			finfo = fileInfo(sb)
+			finfo.Lusername, finfo.Lgroupname = imp.lookupIDs(finfo.Uid(), finfo.Gid())
 		}
 
 		records <- connectors.NewRecord(root, "", finfo, nil, nil)
@@ -95,7 +140,7 @@ func (imp *Importer) walkDir_addPrefixDirectories(root string, records chan<- *c
 	}
 }
 
-func walkdir(client *sftp.Client, info os.FileInfo, p string, walkFn func(string, os.FileInfo, error) error) error {
+func walkdir(client *plakarsftp.Client, info os.FileInfo, p string, walkFn func(string, os.FileInfo, error) error) error {
 	if err := walkFn(p, info, nil); err != nil {
 		return err
 	}
@@ -121,7 +166,7 @@ func walkdir(client *sftp.Client, info os.FileInfo, p string, walkFn func(string
 	return nil
 }
 
-func SFTPWalk(client *sftp.Client, remotePath string, walkFn func(path string, info os.FileInfo, err error) error) error {
+func SFTPWalk(client *plakarsftp.Client, remotePath string, walkFn func(path string, info os.FileInfo, err error) error) error {
 	info, err := client.Lstat(remotePath)
 	if err != nil {
 		err = walkFn(remotePath, nil, err)
@@ -135,3 +180,207 @@ done:
 	}
 	return err
 }
+
+// walker walks a tree with cap(sem) workers reading directories, fed by
+// a bounded queue.  walkFn is never called concurrently.
+type walker struct {
+	client *plakarsftp.Client
+	walkFn func(string, os.FileInfo, error) error
+	sem    chan struct{}
+	queue  chan string
+
+	mu sync.Mutex     // serializes walkFn
+	wg sync.WaitGroup // directories queued but not yet read
+
+	stop    atomic.Bool
+	errOnce sync.Once
+	err     error
+}
+
+func (w *walker) call(p string, info os.FileInfo, err error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.walkFn(p, info, err)
+}
+
+func (w *walker) fail(err error) {
+	w.errOnce.Do(func() { w.err = err })
+	w.stop.Store(true)
+}
+
+func (w *walker) readDir(p string) ([]os.FileInfo, error) {
+	w.sem <- struct{}{}
+	defer func() { <-w.sem }()
+	return w.client.ReadDir(p)
+}
+
+// enqueue hands dir over to any worker, or keeps it on the stack of the
+// calling one when the queue is full, so that workers never wait on each
+// other.
+func (w *walker) enqueue(dir string, stack *[]string) {
+	w.wg.Add(1)
+	select {
+	case w.queue <- dir:
+	default:
+		*stack = append(*stack, dir)
+	}
+}
+
+func (w *walker) visit(p string, info os.FileInfo, stack *[]string) {
+	if w.stop.Load() {
+		return
+	}
+
+	if err := w.call(p, info, nil); err != nil {
+		if err != SkipDir {
+			w.fail(err)
+		}
+		return
+	}
+
+	if info.IsDir() {
+		w.enqueue(p, stack)
+	}
+}
+
+func (w *walker) readAll(p string, stack *[]string) {
+	defer w.wg.Done()
+
+	if w.stop.Load() {
+		return
+	}
+
+	entries, err := w.readDir(p)
+	if err != nil {
+		if err := w.call(p, nil, err); err != nil && err != SkipDir {
+			w.fail(err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		w.visit(path.Join(p, entry.Name()), entry, stack)
+	}
+}
+
+func (w *walker) work() {
+	var stack []string
+	for dir := range w.queue {
+		w.readAll(dir, &stack)
+		for len(stack) > 0 {
+			dir := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			w.readAll(dir, &stack)
+		}
+	}
+}
+
+// listing is the pending result of reading a directory ahead of its visit.
+type listing struct {
+	entries []os.FileInfo
+	err     error
+	done    chan struct{}
+}
+
+func (w *walker) prefetch(p string) *listing {
+	l := &listing{done: make(chan struct{})}
+	go func() {
+		defer close(l.done)
+		l.entries, l.err = w.readDir(p)
+		slices.SortFunc(l.entries, func(a, b os.FileInfo) int {
+			return strings.Compare(a.Name(), b.Name())
+		})
+	}()
+	return l
+}
+
+// visitSorted walks depth-first in lexical order, reading the next
+// subdirectories ahead while the current one is walked.
+func (w *walker) visitSorted(p string, info os.FileInfo, l *listing) error {
+	if err := w.walkFn(p, info, nil); err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return nil
+	}
+
+	<-l.done
+	if l.err != nil {
+		return w.walkFn(p, nil, l.err)
+	}
+
+	window := 2 * cap(w.sem)
+	pending := make([]*listing, len(l.entries))
+	next := 0
+
+	for i, entry := range l.entries {
+		for ; next < len(l.entries) && next <= i+window; next++ {
+			if l.entries[next].IsDir() {
+				pending[next] = w.prefetch(path.Join(p, l.entries[next].Name()))
+			}
+		}
+
+		err := w.visitSorted(path.Join(p, entry.Name()), entry, pending[i])
+		pending[i] = nil
+		if err != nil {
+			if err == SkipDir {
+				continue
+			}
+			// let the reads in flight finish
+			for _, l := range pending[i+1 : next] {
+				if l != nil {
+					<-l.done
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// SFTPWalkParallel is SFTPWalk with up to concurrency directories being
+// read at once.  Entries are visited in no particular order, unless sorted
+// is set in which case the walk is depth-first in lexical order, like
+// SFTPWalk over a sorted listing.
+func SFTPWalkParallel(client *plakarsftp.Client, remotePath string, concurrency int, sorted bool, walkFn func(path string, info os.FileInfo, err error) error) error {
+	concurrency = max(concurrency, 1)
+	w := &walker{
+		client: client,
+		walkFn: walkFn,
+		sem:    make(chan struct{}, concurrency),
+		queue:  make(chan string, 16*concurrency),
+	}
+
+	info, err := client.Lstat(remotePath)
+	if err != nil {
+		err = walkFn(remotePath, nil, err)
+	} else if sorted {
+		var l *listing
+		if info.IsDir() {
+			l = w.prefetch(remotePath)
+		}
+		err = w.visitSorted(remotePath, info, l)
+	} else {
+		var workers sync.WaitGroup
+		for range concurrency {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				w.work()
+			}()
+		}
+
+		// the queue is empty, the root directory is never kept on the stack
+		w.visit(remotePath, info, nil)
+		w.wg.Wait()
+		close(w.queue)
+		workers.Wait()
+		err = w.err
+	}
+
+	if err == SkipDir || err == SkipAll {
+		err = nil
+	}
+	return err
+}
@@ -18,41 +18,69 @@ package storage
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"path"
 	"sync"
+	"sync/atomic"
 
+	plakarsftp "github.com/PlakarKorp/integration-sftp/common"
 	"github.com/PlakarKorp/kloset/connectors/storage"
 	"github.com/PlakarKorp/kloset/objects"
 	"github.com/PlakarKorp/kloset/reading"
-	"github.com/pkg/sftp"
 	"golang.org/x/sync/errgroup"
 )
 
 type Buckets struct {
-	client *sftp.Client
-	path   string
+	pool     *plakarsftp.Pool
+	path     string
+	tmpdir   string
+	opts     WriteOptions
+	progress *plakarsftp.Progress
+	upload   *plakarsftp.Limiter
+	download *plakarsftp.Limiter
 }
 
-func NewBuckets(sftpClient *sftp.Client, path string) Buckets {
+func NewBuckets(pool *plakarsftp.Pool, path string, tmpdir string, opts WriteOptions, progress *plakarsftp.Progress, upload, download *plakarsftp.Limiter) Buckets {
 	return Buckets{
-		client: sftpClient,
-		path:   path,
+		pool:     pool,
+		path:     path,
+		tmpdir:   tmpdir,
+		opts:     opts,
+		progress: progress,
+		upload:   upload,
+		download: download,
 	}
 }
 
+// releaseReadCloser gives the session back to the pool once the caller
+// is done reading.
+type releaseReadCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+func (rd *releaseReadCloser) Close() error {
+	defer rd.release()
+	return rd.ReadCloser.Close()
+}
+
 func (buckets *Buckets) Create() error {
 	var g errgroup.Group
 
 	for i := 0; i < 256; i++ {
 		i := i // capture the current value of i
 		g.Go(func() error {
+			client, release := buckets.pool.Acquire()
+			defer release()
+
 			dir := path.Join(buckets.path, fmt.Sprintf("%02x", i))
-			if err := buckets.client.MkdirAll(dir); err != nil {
+			if err := client.MkdirAll(dir); err != nil {
 				return err
 			}
-			if err := buckets.client.Chmod(dir, 0755); err != nil {
+			if err := client.Chmod(dir, 0755); err != nil {
 				return err
 			}
 			return nil
@@ -72,7 +100,10 @@ func (buckets *Buckets) List() ([]objects.MAC, error) {
 		wg.Add(1)
 		go func(path string) {
 			defer wg.Done()
-			entries, err := buckets.client.ReadDir(path)
+
+			client, release := buckets.pool.Acquire()
+			entries, err := client.ReadDir(path)
+			release()
 			if err != nil {
 				return
 			}
@@ -103,6 +134,42 @@ func (buckets *Buckets) List() ([]objects.MAC, error) {
 	return ret, nil
 }
 
+// Size returns the total size of the objects in the buckets.
+func (buckets *Buckets) Size() (int64, error) {
+	var size atomic.Int64
+	var g errgroup.Group
+
+	for i := 0; i < 256; i++ {
+		path := path.Join(buckets.path, fmt.Sprintf("%02x", i))
+		g.Go(func() error {
+			client, release := buckets.pool.Acquire()
+			entries, err := client.ReadDir(path)
+			release()
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			for _, entry := range entries {
+				if entry.IsDir() {
+					continue
+				}
+				if len(entry.Name()) != 64 {
+					continue
+				}
+				size.Add(entry.Size())
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return -1, err
+	}
+	return size.Load(), nil
+}
+
 func (buckets *Buckets) Path(mac objects.MAC) string {
 	return path.Join(buckets.path,
 		fmt.Sprintf("%02x", mac[0]),
@@ -110,22 +177,48 @@ func (buckets *Buckets) Path(mac objects.MAC) string {
 }
 
 func (buckets *Buckets) Get(mac objects.MAC, rg *storage.Range) (io.ReadCloser, error) {
-	fp, err := buckets.client.Open(buckets.Path(mac))
+	client, release := buckets.pool.Acquire()
+
+	fp, err := client.Open(buckets.Path(mac))
 	if err != nil {
+		release()
 		return nil, err
 	}
 
 	if rg == nil {
-		return fp, nil
+		size := int64(-1)
+		if buckets.progress != nil {
+			if info, err := fp.Stat(); err == nil {
+				size = info.Size()
+			}
+		}
+		transfer := buckets.progress.Start("get", fmt.Sprintf("%x", mac), size)
+		return &releaseReadCloser{transfer.ReadCloser(buckets.download.ReadCloser(fp)), release}, nil
 	}
 
-	return reading.NewSectionReadCloser(fp, int64(rg.Offset), int64(rg.Length)), nil
+	transfer := buckets.progress.Start("get", fmt.Sprintf("%x", mac), int64(rg.Length))
+	rd := reading.NewSectionReadCloser(fp, int64(rg.Offset), int64(rg.Length))
+	return &releaseReadCloser{transfer.ReadCloser(buckets.download.ReadCloser(rd)), release}, nil
 }
 
 func (buckets *Buckets) Remove(mac objects.MAC) error {
-	return buckets.client.Remove(buckets.Path(mac))
+	client, release := buckets.pool.Acquire()
+	defer release()
+
+	return client.Remove(buckets.Path(mac))
 }
 
 func (buckets *Buckets) Put(mac objects.MAC, rd io.Reader) (int64, error) {
-	return WriteToFileAtomicTempDir(buckets.client, buckets.Path(mac), rd, buckets.path)
+	client, release := buckets.pool.Acquire()
+	defer release()
+
+	size := int64(-1)
+	if sized, ok := rd.(interface{ Len() int }); ok {
+		size = int64(sized.Len())
+	}
+	transfer := buckets.progress.Start("put", fmt.Sprintf("%x", mac), size)
+
+	nbytes, err := WriteToFileAtomicTempDir(client, buckets.Path(mac), transfer.Reader(buckets.upload.Reader(rd)), buckets.tmpdir, buckets.opts)
+	transfer.Done(err)
+	return nbytes, err
 }
@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2025 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	plakarsftp "github.com/PlakarKorp/integration-sftp/common"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// ErrLockHeld is returned when creating a lock that already exists.
+var ErrLockHeld = errors.New("sftp: lock held")
+
+// LockLease records who holds a lock and when it was last refreshed.  It
+// is kept in a .lease file next to the lock.
+type LockLease struct {
+	Hostname  string    `json:"hostname"`
+	PID       int       `json:"pid"`
+	Created   time.Time `json:"created"`
+	Refreshed time.Time `json:"refreshed"`
+}
+
+// LockInfo describes a lock of the repository.
+type LockInfo struct {
+	ID    objects.MAC
+	Lease LockLease
+	Stale bool
+}
+
+func (s *Store) lockPath(mac objects.MAC) string {
+	return path.Join(s.Path("locks"), hex.EncodeToString(mac[:]))
+}
+
+func (s *Store) leasePath(mac objects.MAC) string {
+	return s.lockPath(mac) + ".lease"
+}
+
+func (s *Store) readLease(client *plakarsftp.Client, mac objects.MAC) (*LockLease, error) {
+	rd, err := client.Open(s.leasePath(mac))
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	var lease LockLease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+func (s *Store) putLock(ctx context.Context, mac objects.MAC, rd io.Reader) (int64, error) {
+	client, release := s.pool.Acquire()
+	defer release()
+
+	// kloset refreshes its locks by putting them again, only the first
+	// put has to win the race for the name
+	_, held := s.heldLocks.Load(mac)
+
+	nbytes, err := WriteToFileAtomicTempDir(client, s.lockPath(mac), rd, s.Path("tmp"), WriteOptions{NoClobber: !held})
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			if lease, err := s.readLease(client, mac); err == nil {
+				return 0, fmt.Errorf("%w: %x by %s[%d] since %s", ErrLockHeld, mac,
+					lease.Hostname, lease.PID, lease.Created.Format(time.RFC3339))
+			}
+			return 0, fmt.Errorf("%w: %x", ErrLockHeld, mac)
+		}
+		return nbytes, err
+	}
+	s.heldLocks.Store(mac, struct{}{})
+
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	lease := LockLease{
+		Hostname:  hostname,
+		PID:       os.Getpid(),
+		Created:   now,
+		Refreshed: now,
+	}
+	if prev, err := s.readLease(client, mac); err == nil {
+		lease.Created = prev.Created
+	}
+
+	// the lock itself is in place, a missing lease only makes it look
+	// older than it is
+	if data, err := json.Marshal(lease); err == nil {
+		if _, err := WriteToFileAtomicTempDir(client, s.leasePath(mac), bytes.NewReader(data), s.Path("tmp"), WriteOptions{}); err != nil {
+			plakarsftp.Logger(ctx).Warn("sftp: failed to write lease of lock %x: %v", mac, err)
+		}
+	}
+
+	return nbytes, nil
+}
+
+func (s *Store) deleteLock(ctx context.Context, mac objects.MAC) error {
+	client, release := s.pool.Acquire()
+	defer release()
+
+	s.heldLocks.Delete(mac)
+	if err := client.Remove(s.lockPath(mac)); err != nil {
+		return err
+	}
+
+	if err := client.Remove(s.leasePath(mac)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		plakarsftp.Logger(ctx).Warn("sftp: failed to remove lease of lock %x: %v", mac, err)
+	}
+	return nil
+}
+
+// Locks returns the locks of the repository along with their lease.  Locks
+// without a lease are dated by their modification time.  A lock is stale
+// when it has not been refreshed for lock_ttl.
+func (s *Store) Locks(ctx context.Context) ([]LockInfo, error) {
+	macs, err := s.getLocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client, release := s.pool.Acquire()
+	defer release()
+
+	ret := make([]LockInfo, 0, len(macs))
+	for _, mac := range macs {
+		lease, err := s.readLease(client, mac)
+		if err != nil {
+			info, err := client.Lstat(s.lockPath(mac))
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				return nil, err
+			}
+			lease = &LockLease{
+				Created:   info.ModTime(),
+				Refreshed: info.ModTime(),
+			}
+		}
+
+		ret = append(ret, LockInfo{
+			ID:    mac,
+			Lease: *lease,
+			Stale: s.lockTTL > 0 && time.Since(lease.Refreshed) > s.lockTTL,
+		})
+	}
+
+	return ret, nil
+}
+
+// ReapStaleLocks removes the stale locks and returns their identifiers.
+func (s *Store) ReapStaleLocks(ctx context.Context) ([]objects.MAC, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	if s.lockTTL == 0 {
+		return nil, nil
+	}
+
+	locks, err := s.Locks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var reaped []objects.MAC
+	for _, lock := range locks {
+		if !lock.Stale {
+			continue
+		}
+		if err := s.deleteLock(ctx, lock.ID); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return reaped, err
+		}
+		plakarsftp.Logger(ctx).Info("sftp: reaped stale lock %x held by %s[%d] since %s",
+			lock.ID, lock.Lease.Hostname, lock.Lease.PID, lock.Lease.Refreshed.Format(time.RFC3339))
+		reaped = append(reaped, lock.ID)
+	}
+
+	return reaped, nil
+}
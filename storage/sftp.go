@@ -24,28 +24,55 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"math/rand/v2"
 	"net/url"
+	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	plakarsftp "github.com/PlakarKorp/integration-sftp/common"
 	"github.com/PlakarKorp/kloset/connectors/storage"
 	"github.com/PlakarKorp/kloset/location"
 	"github.com/PlakarKorp/kloset/objects"
-	"github.com/pkg/sftp"
 )
 
 func init() {
 	storage.Register("sftp", 0, NewStore)
 }
 
+// ErrReadOnly is returned when writing to a read-only repository.
+var ErrReadOnly = fmt.Errorf("sftp: repository is read-only: %w", storage.ErrNotWritable)
+
+// ErrAppendOnly is returned when deleting or overwriting packfiles and
+// states of an append-only repository.
+var ErrAppendOnly = errors.New("sftp: repository is append-only")
+
 type Store struct {
 	packfiles Buckets
 	states    Buckets
-	client    *sftp.Client
-
-	config   map[string]string
-	endpoint *url.URL
+	pool      *plakarsftp.Pool
+
+	config     map[string]string
+	endpoint   *url.URL
+	writeOpts  WriteOptions
+	sizeTTL    time.Duration
+	spaceCheck *plakarsftp.SpaceCheck
+	readOnly   bool
+	appendOnly bool
+	lockTTL    time.Duration
+	lockReap   bool
+	tmpMaxAge  time.Duration
+	progress   *plakarsftp.Progress
+	upload     *plakarsftp.Limiter
+	download   *plakarsftp.Limiter
+
+	// diagnostics makes Ping probe writes as Diagnostics does
+	diagnostics bool
+
+	heldLocks sync.Map // map[objects.MAC]struct{}, locks created by this store
 }
 
 func NewStore(ctx context.Context, proto string, storeConfig map[string]string) (storage.Store, error) {
@@ -81,9 +108,111 @@ func NewStore(ctx context.Context, proto string, storeConfig map[string]string)
 	}
 	parsed.Path = rootDir
 
+	var writeOpts WriteOptions
+	if value, ok := storeConfig["resumable_uploads"]; ok {
+		if writeOpts.Resumable, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid resumable_uploads: %q", value)
+		}
+	}
+	if value, ok := storeConfig["verify_uploads"]; ok {
+		if writeOpts.Verify, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid verify_uploads: %q", value)
+		}
+	}
+	if writeOpts.Concurrency, err = plakarsftp.WriteConcurrency(storeConfig); err != nil {
+		return nil, err
+	}
+	if writeOpts.Durability, err = plakarsftp.ParseDurability(storeConfig); err != nil {
+		return nil, err
+	}
+
+	var sizeTTL time.Duration
+	if value, ok := storeConfig["size_cache_ttl"]; ok {
+		if sizeTTL, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid size_cache_ttl: %q", value)
+		}
+	}
+
+	var readOnly bool
+	if value, ok := storeConfig["read_only"]; ok {
+		if readOnly, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid read_only: %q", value)
+		}
+	}
+
+	var appendOnly bool
+	if value, ok := storeConfig["append_only"]; ok {
+		if appendOnly, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid append_only: %q", value)
+		}
+	}
+	writeOpts.NoClobber = appendOnly
+
+	var lockTTL time.Duration
+	if value, ok := storeConfig["lock_ttl"]; ok {
+		if lockTTL, err = time.ParseDuration(value); err != nil || lockTTL < 0 {
+			return nil, fmt.Errorf("invalid lock_ttl: %q", value)
+		}
+	}
+
+	tmpMaxAge := defaultTmpMaxAge
+	if value, ok := storeConfig["tmp_max_age"]; ok {
+		if tmpMaxAge, err = time.ParseDuration(value); err != nil || tmpMaxAge < 0 {
+			return nil, fmt.Errorf("invalid tmp_max_age: %q", value)
+		}
+	}
+
+	var progress *plakarsftp.Progress
+	if value, ok := storeConfig["verbose_transfer"]; ok {
+		verbose, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid verbose_transfer: %q", value)
+		}
+		if verbose {
+			progress = plakarsftp.NewProgress(plakarsftp.Logger(ctx))
+		}
+	}
+
+	upload, download, err := plakarsftp.ParseLimits(storeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var lockReap bool
+	if value, ok := storeConfig["reap_stale_locks"]; ok {
+		if lockReap, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid reap_stale_locks: %q", value)
+		}
+	}
+
+	spaceCheck, err := plakarsftp.ParseSpaceCheck(storeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var diagnostics bool
+	if value, ok := storeConfig["diagnostics"]; ok {
+		if diagnostics, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid diagnostics: %q", value)
+		}
+	}
+
 	return &Store{
-		config:   storeConfig,
-		endpoint: parsed,
+		config:     storeConfig,
+		endpoint:   parsed,
+		writeOpts:  writeOpts,
+		sizeTTL:    sizeTTL,
+		spaceCheck: spaceCheck,
+		readOnly:   readOnly,
+		appendOnly: appendOnly,
+		lockTTL:    lockTTL,
+		lockReap:   lockReap,
+		tmpMaxAge:  tmpMaxAge,
+		progress:   progress,
+		upload:     upload,
+		download:   download,
+
+		diagnostics: diagnostics,
 	}, nil
 }
 
@@ -103,14 +232,35 @@ func (s *Store) Root() string {
 	return s.endpoint.Path
 }
 
+// Ping checks the repository without writing to it, unless the
+// diagnostics option asks for the write probe of Diagnostics.
 func (s *Store) Ping(ctx context.Context) error {
-	client, err := plakarsftp.Connect(s.endpoint, s.config)
+	client, err := plakarsftp.NewClient(s.endpoint, s.config)
 	if err != nil {
 		return err
 	}
+	defer client.Close()
 
-	_, err = client.Lstat(s.endpoint.Path)
-	return err
+	d, err := plakarsftp.Diagnose(ctx, client, s.endpoint.Path, s.diagnostics && !s.readOnly)
+	if err != nil {
+		return err
+	}
+	d.Log(ctx)
+
+	return s.spaceCheck.Check(ctx, client, s.Path())
+}
+
+// Diagnostics reports what the server supports, its latency and
+// throughput, and whether files can be written, renamed and deleted in
+// the repository directory unless it is read-only.
+func (s *Store) Diagnostics(ctx context.Context) (*plakarsftp.Diagnostics, error) {
+	client, err := plakarsftp.NewClient(s.endpoint, s.config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	return plakarsftp.Diagnose(ctx, client, s.endpoint.Path, !s.readOnly)
 }
 
 func (s *Store) List(ctx context.Context, res storage.StorageResource) ([]objects.MAC, error) {
@@ -146,26 +296,40 @@ func (s *Store) Get(ctx context.Context, res storage.StorageResource, mac object
 }
 
 func (s *Store) Put(ctx context.Context, res storage.StorageResource, mac objects.MAC, rd io.Reader) (int64, error) {
+	if s.readOnly {
+		return -1, ErrReadOnly
+	}
+
 	switch res {
 	case storage.StorageResourcePackfile:
-		return s.packfiles.Put(mac, rd)
+		return s.appendOnlyErr(s.packfiles.Put(mac, rd))
 	case storage.StorageResourceState:
-		return s.states.Put(mac, rd)
+		return s.appendOnlyErr(s.states.Put(mac, rd))
 	case storage.StorageResourceLock:
-		return WriteToFileAtomicTempDir(s.client, path.Join(s.Path("locks"), hex.EncodeToString(mac[:])), rd, s.Path(""))
+		return s.putLock(ctx, mac, rd)
 	default:
 		return -1, errors.ErrUnsupported
 	}
 }
 
 func (s *Store) Delete(ctx context.Context, res storage.StorageResource, mac objects.MAC) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
 	switch res {
 	case storage.StorageResourcePackfile:
+		if s.appendOnly {
+			return ErrAppendOnly
+		}
 		return s.packfiles.Remove(mac)
 	case storage.StorageResourceState:
+		if s.appendOnly {
+			return ErrAppendOnly
+		}
 		return s.states.Remove(mac)
 	case storage.StorageResourceLock:
-		return s.client.Remove(path.Join(s.Path("locks"), hex.EncodeToString(mac[:])))
+		return s.deleteLock(ctx, mac)
 	default:
 		return errors.ErrUnsupported
 	}
@@ -192,11 +356,18 @@ func (s *Store) Path(args ...string) string {
 }
 
 func (s *Store) Create(ctx context.Context, config []byte) error {
-	client, err := plakarsftp.Connect(s.endpoint, s.config)
+	pool, err := plakarsftp.NewPool(s.endpoint, s.config)
 	if err != nil {
 		return err
 	}
-	s.client = client
+	s.pool = pool
+
+	client, release := pool.Acquire()
+	defer release()
+
+	if err := s.spaceCheck.Check(ctx, client, s.Path()); err != nil {
+		return err
+	}
 
 	dirfp, err := client.ReadDir(s.Path())
 	if err != nil {
@@ -216,12 +387,17 @@ func (s *Store) Create(ctx context.Context, config []byte) error {
 			return fmt.Errorf("directory %s is not empty", s.endpoint.Path)
 		}
 	}
-	s.packfiles = NewBuckets(client, s.Path("packfiles"))
+	err = client.Mkdir(s.Path("tmp"))
+	if err != nil {
+		return err
+	}
+
+	s.packfiles = NewBuckets(pool, s.Path("packfiles"), s.Path("tmp"), s.writeOpts, s.progress, s.upload, s.download)
 	if err := s.packfiles.Create(); err != nil {
 		return err
 	}
 
-	s.states = NewBuckets(client, s.Path("states"))
+	s.states = NewBuckets(pool, s.Path("states"), s.Path("tmp"), s.writeOpts, s.progress, s.upload, s.download)
 	if err := s.states.Create(); err != nil {
 		return err
 	}
@@ -231,16 +407,34 @@ func (s *Store) Create(ctx context.Context, config []byte) error {
 		return err
 	}
 
-	_, err = WriteToFileAtomic(client, s.Path("CONFIG"), bytes.NewReader(config))
+	_, err = WriteToFileAtomicTempDir(client, s.Path("CONFIG"), bytes.NewReader(config), s.Path("tmp"),
+		WriteOptions{Durability: s.writeOpts.Durability})
 	return err
 }
 
 func (s *Store) Open(ctx context.Context) ([]byte, error) {
-	client, err := plakarsftp.Connect(s.endpoint, s.config)
+	pool, err := plakarsftp.NewPool(s.endpoint, s.config)
 	if err != nil {
 		return nil, err
 	}
-	s.client = client
+	s.pool = pool
+
+	client, release := pool.Acquire()
+	defer release()
+
+	if !s.readOnly {
+		writable, err := s.writable(client)
+		if err != nil {
+			return nil, err
+		}
+		s.readOnly = !writable
+	}
+
+	if !s.readOnly {
+		if err := s.spaceCheck.Check(ctx, client, s.Path()); err != nil {
+			return nil, err
+		}
+	}
 
 	rd, err := client.Open(s.Path("CONFIG"))
 	if err != nil {
@@ -253,35 +447,115 @@ func (s *Store) Open(ctx context.Context) ([]byte, error) {
 		return nil, err
 	}
 
-	s.packfiles = NewBuckets(client, s.Path("packfiles"))
+	s.packfiles = NewBuckets(pool, s.Path("packfiles"), s.Path("tmp"), s.writeOpts, s.progress, s.upload, s.download)
+
+	s.states = NewBuckets(pool, s.Path("states"), s.Path("tmp"), s.writeOpts, s.progress, s.upload, s.download)
 
-	s.states = NewBuckets(client, s.Path("states"))
+	if !s.readOnly {
+		if err := s.sweepTemp(ctx, client); err != nil {
+			plakarsftp.Logger(ctx).Warn("sftp: failed to remove stale temporary files: %v", err)
+		}
+	}
+
+	if s.lockReap && !s.readOnly {
+		if _, err := s.ReapStaleLocks(ctx); err != nil {
+			plakarsftp.Logger(ctx).Warn("sftp: failed to reap stale locks: %v", err)
+		}
+	}
 
 	return data, nil
 }
 
 func (s *Store) Mode(ctx context.Context) (storage.Mode, error) {
+	if s.readOnly {
+		return storage.ModeRead, nil
+	}
 	return storage.ModeRead | storage.ModeWrite, nil
 }
 
+// appendOnlyErr reports refused overwrites of an append-only repository
+// as ErrAppendOnly.
+func (s *Store) appendOnlyErr(n int64, err error) (int64, error) {
+	if s.appendOnly && errors.Is(err, fs.ErrExist) {
+		return n, fmt.Errorf("%w: %w", ErrAppendOnly, err)
+	}
+	return n, err
+}
+
+// writable probes whether the repository can be written to: CONFIG must
+// open for writing and a file must be creatable in tmp.  Only a refused
+// permission means it is not, other errors are returned.
+func (s *Store) writable(client *plakarsftp.Client) (bool, error) {
+	fp, err := client.OpenFile(s.Path("CONFIG"), os.O_WRONLY)
+	if err != nil {
+		return notWritable(err)
+	}
+	fp.Close()
+
+	// repositories created before tmp/ was introduced lack it
+	if err := client.MkdirAll(s.Path("tmp")); err != nil {
+		return notWritable(err)
+	}
+
+	probe := s.Path("tmp", fmt.Sprintf(".plakar-probe.%016x", rand.Uint64()))
+	fp, err = client.OpenFile(probe, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return notWritable(err)
+	}
+	fp.Close()
+	client.Remove(probe)
+
+	return true, nil
+}
+
+func notWritable(err error) (bool, error) {
+	if errors.Is(err, fs.ErrPermission) {
+		return false, nil
+	}
+	return false, err
+}
+
+// Size returns the space used by the packfiles and states.  Free space is
+// not a repository size, it is reported by Ping instead.
 func (s *Store) Size(ctx context.Context) (int64, error) {
-	return -1, nil
+	if s.sizeTTL > 0 {
+		if size, ok := s.cachedSize(); ok {
+			return size, nil
+		}
+	}
+
+	size, err := s.walkSize()
+	if err != nil {
+		return -1, err
+	}
+
+	if s.sizeTTL > 0 && !s.readOnly {
+		// best effort, the size is recomputed if the cache is missing
+		s.storeSize(size)
+	}
+
+	return size, nil
 }
 
 func (s *Store) Close(ctx context.Context) error {
+	if s.pool != nil {
+		return s.pool.Close()
+	}
 	return nil
 }
 
 /* Locks */
 func (s *Store) getLocks(ctx context.Context) (ret []objects.MAC, err error) {
-	entries, err := s.client.ReadDir(s.Path("locks"))
+	client, release := s.pool.Acquire()
+	defer release()
+
+	entries, err := client.ReadDir(s.Path("locks"))
 	if err != nil {
 		return
 	}
 
 	for i := range entries {
-		var t []byte
-		t, err = hex.DecodeString(entries[i].Name())
+		t, err := hex.DecodeString(entries[i].Name())
 		if err != nil {
 			continue
 		}
@@ -294,10 +568,13 @@ func (s *Store) getLocks(ctx context.Context) (ret []objects.MAC, err error) {
 }
 
 func (s *Store) getLock(ctx context.Context, lockID objects.MAC) (io.ReadCloser, error) {
-	fp, err := s.client.Open(path.Join(s.Path("locks"), hex.EncodeToString(lockID[:])))
+	client, release := s.pool.Acquire()
+
+	fp, err := client.Open(path.Join(s.Path("locks"), hex.EncodeToString(lockID[:])))
 	if err != nil {
+		release()
 		return nil, err
 	}
 
-	return fp, nil
+	return &releaseReadCloser{fp, release}, nil
 }
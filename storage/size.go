@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2025 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// sizeCache is the content of the SIZE sidecar file, which saves walking
+// every bucket each time the repository size is asked for.
+type sizeCache struct {
+	Size      int64     `json:"size"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (s *Store) cachedSize() (int64, bool) {
+	client, release := s.pool.Acquire()
+	defer release()
+
+	rd, err := client.Open(s.Path("SIZE"))
+	if err != nil {
+		return -1, false
+	}
+	defer rd.Close()
+
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return -1, false
+	}
+
+	var cache sizeCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return -1, false
+	}
+
+	if time.Since(cache.Timestamp) > s.sizeTTL {
+		return -1, false
+	}
+	return cache.Size, true
+}
+
+func (s *Store) storeSize(size int64) error {
+	data, err := json.Marshal(sizeCache{
+		Size:      size,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	client, release := s.pool.Acquire()
+	defer release()
+
+	_, err = WriteToFileAtomicTempDir(client, s.Path("SIZE"), bytes.NewReader(data), s.Path("tmp"), WriteOptions{})
+	return err
+}
+
+func (s *Store) walkSize() (int64, error) {
+	packfiles, err := s.packfiles.Size()
+	if err != nil {
+		return -1, err
+	}
+
+	states, err := s.states.Size()
+	if err != nil {
+		return -1, err
+	}
+
+	return packfiles + states, nil
+}
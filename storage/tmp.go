@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2025 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"time"
+
+	plakarsftp "github.com/PlakarKorp/integration-sftp/common"
+)
+
+// temporary files untouched for this long are left over by crashed or
+// abandoned uploads
+const defaultTmpMaxAge = 24 * time.Hour
+
+// sweepTemp removes the files of the tmp directory that were last
+// modified more than tmp_max_age ago.
+func (s *Store) sweepTemp(ctx context.Context, client *plakarsftp.Client) error {
+	if s.tmpMaxAge == 0 {
+		return nil
+	}
+
+	entries, err := client.ReadDir(s.Path("tmp"))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		if entry.IsDir() || time.Since(entry.ModTime()) < s.tmpMaxAge {
+			continue
+		}
+		err := client.Remove(path.Join(s.Path("tmp"), entry.Name()))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+		plakarsftp.Logger(ctx).Info("sftp: removed stale temporary file %s", entry.Name())
+	}
+
+	return errors.Join(errs...)
+}
@@ -17,37 +17,99 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
 	"path"
 
-	"github.com/pkg/sftp"
+	plakarsftp "github.com/PlakarKorp/integration-sftp/common"
 )
 
-func WriteToFileAtomic(sftpClient *sftp.Client, filename string, rd io.Reader) (int64, error) {
-	return WriteToFileAtomicTempDir(sftpClient, filename, rd, path.Dir(filename))
+// WriteOptions tunes how objects are written to the repository.
+type WriteOptions struct {
+	// Resumable keeps the temporary file of a failed upload so that a
+	// later attempt resumes from where it stopped, if the input is
+	// seekable.
+	Resumable bool
+
+	// Verify checks each upload against a server-side hash when the
+	// server supports one, or by reading it back, before it is renamed
+	// into place.
+	Verify bool
+
+	// NoClobber refuses to replace an existing file.
+	NoClobber bool
+
+	// Concurrency is the number of concurrent write requests per
+	// upload, 0 for the default.
+	Concurrency int
+
+	// Durability is how far writes are flushed before they are renamed
+	// into place.
+	Durability plakarsftp.Durability
 }
 
-func WriteToFileAtomicTempDir(sftpClient *sftp.Client, filename string, rd io.Reader, tmpdir string) (int64, error) {
-	tmp := fmt.Sprintf("%s.tmp", filename)
+func WriteToFileAtomic(sftpClient *plakarsftp.Client, filename string, rd io.Reader) (int64, error) {
+	return WriteToFileAtomicTempDir(sftpClient, filename, rd, path.Dir(filename), WriteOptions{})
+}
+
+func WriteToFileAtomicTempDir(sftpClient *plakarsftp.Client, filename string, rd io.Reader, tmpdir string, opts WriteOptions) (int64, error) {
+	tmp := path.Join(tmpdir, fmt.Sprintf("%s.tmp.%d", path.Base(filename), rand.Int()))
+
+	if opts.NoClobber {
+		if _, err := sftpClient.Lstat(filename); err == nil {
+			return 0, &fs.PathError{Op: "put", Path: filename, Err: fs.ErrExist}
+		}
+	}
+
+	if seeker, ok := rd.(io.ReadSeeker); ok && opts.Resumable {
+		// a later attempt has to find the temporary file again
+		partial := path.Join(tmpdir, path.Base(filename)+".partial")
+		return writeResumable(sftpClient, filename, partial, seeker, opts)
+	}
+
 	f, err := sftpClient.Create(tmp)
 	if err != nil {
 		return 0, err
 	}
 
+	var d *digest
+	if opts.Verify {
+		d = newDigest()
+		rd = io.TeeReader(rd, d)
+	}
+
 	var nbytes int64
-	if nbytes, err = f.ReadFromWithConcurrency(rd, 0); err != nil {
+	if nbytes, err = f.ReadFromWithConcurrency(rd, opts.Concurrency); err != nil {
 		f.Close()
 		sftpClient.Remove(f.Name())
 		return 0, err
 	}
 
+	if opts.Durability >= plakarsftp.DurabilityFile {
+		if err := sftpClient.Sync(f); err != nil {
+			f.Close()
+			sftpClient.Remove(f.Name())
+			return 0, err
+		}
+	}
+
 	if err = f.Close(); err != nil {
 		sftpClient.Remove(f.Name())
 		return 0, err
 	}
 
-	err = sftpClient.Rename(f.Name(), filename)
+	if d != nil {
+		if err := verifyUpload(sftpClient, f.Name(), d); err != nil {
+			sftpClient.Remove(f.Name())
+			return 0, err
+		}
+	}
+
+	err = commit(sftpClient, f.Name(), filename, opts)
 	if err != nil {
 		sftpClient.Remove(f.Name())
 		return 0, err
@@ -55,3 +117,172 @@ func WriteToFileAtomicTempDir(sftpClient *sftp.Client, filename string, rd io.Re
 
 	return nbytes, nil
 }
+
+// resumeChunk is the amount of data written concurrently before moving on,
+// an interrupted upload resumes from the start of the chunk it was at.
+const resumeChunk = 8 * 1024 * 1024
+
+// resumeOffset returns where to resume an upload whose temporary file has
+// size bytes.  Chunks are written one after the other, each concurrently,
+// so every chunk before the one the size falls in is complete while that
+// one may have holes, even when the size ends on its last byte.
+func resumeOffset(size int64) int64 {
+	if size == 0 {
+		return 0
+	}
+	return (size - 1) / resumeChunk * resumeChunk
+}
+
+// errShortInput is returned when the input ends before the size it had
+// when the upload started, distinct from io.ErrUnexpectedEOF which means a
+// lost connection and would be retried.
+var errShortInput = errors.New("input shorter than its size")
+
+// writeResumable appends rd to whatever a previous attempt left in tmp.
+func writeResumable(sftpClient *plakarsftp.Client, filename, tmp string, rd io.ReadSeeker, opts WriteOptions) (int64, error) {
+	size, err := rd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	err = sftpClient.Retry(func() error {
+		var offset int64
+		if info, err := sftpClient.Stat(tmp); err == nil {
+			offset = resumeOffset(info.Size())
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		flags := os.O_WRONLY | os.O_CREATE
+		if offset > size {
+			// not a prefix of this input, start over
+			offset = 0
+			flags |= os.O_TRUNC
+		}
+
+		if _, err := rd.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		f, err := sftpClient.OpenFile(tmp, flags)
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return err
+		}
+
+		for offset < size {
+			n, err := f.ReadFromWithConcurrency(io.LimitReader(rd, resumeChunk), opts.Concurrency)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			if n == 0 {
+				f.Close()
+				return errShortInput
+			}
+			offset += n
+		}
+
+		// drop what a previous attempt with a longer input left past the end
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return err
+		}
+
+		if opts.Durability >= plakarsftp.DurabilityFile {
+			if err := sftpClient.Sync(f); err != nil {
+				f.Close()
+				return err
+			}
+		}
+
+		return f.Close()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var d *digest
+	if opts.Verify {
+		// part of the data was sent by an earlier attempt, hash it all
+		d = newDigest()
+		if _, err := rd.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.Copy(d, rd); err != nil {
+			return 0, err
+		}
+		if err := verifyUpload(sftpClient, tmp, d); err != nil {
+			if errors.Is(err, fs.ErrNotExist) && committedConcurrently(sftpClient, filename, size, d) {
+				return size, nil
+			}
+			sftpClient.Remove(tmp)
+			return 0, err
+		}
+	}
+
+	if err := commit(sftpClient, tmp, filename, opts); err != nil {
+		if errors.Is(err, fs.ErrNotExist) && committedConcurrently(sftpClient, filename, size, d) {
+			return size, nil
+		}
+		sftpClient.Remove(tmp)
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// committedConcurrently reports whether another upload of the same object,
+// sharing the temporary file, moved it into place first.  Both wrote the
+// same data, so filename only has to hold it.
+func committedConcurrently(sftpClient *plakarsftp.Client, filename string, size int64, d *digest) bool {
+	info, err := sftpClient.Stat(filename)
+	if err != nil || info.Size() != size {
+		return false
+	}
+	if d != nil {
+		return verifyUpload(sftpClient, filename, d) == nil
+	}
+	return true
+}
+
+// commit moves tmp into place as filename.
+func commit(sftpClient *plakarsftp.Client, tmp, filename string, opts WriteOptions) error {
+	if err := rename(sftpClient, tmp, filename, opts); err != nil {
+		return err
+	}
+
+	if opts.Durability >= plakarsftp.DurabilityFull {
+		sftpClient.SyncDir(path.Dir(filename))
+	}
+	return nil
+}
+
+func rename(sftpClient *plakarsftp.Client, tmp, filename string, opts WriteOptions) error {
+	if !opts.NoClobber {
+		return sftpClient.Replace(tmp, filename)
+	}
+
+	// a hard link fails if filename exists, without any window for a
+	// concurrent writer to slip in
+	if _, ok := sftpClient.HasExtension("hardlink@openssh.com"); ok {
+		if err := sftpClient.Link(tmp, filename); err != nil {
+			if _, err := sftpClient.Lstat(filename); err == nil {
+				return &fs.PathError{Op: "put", Path: filename, Err: fs.ErrExist}
+			}
+			return err
+		}
+		sftpClient.Remove(tmp)
+		return nil
+	}
+
+	if _, err := sftpClient.Lstat(filename); err == nil {
+		return &fs.PathError{Op: "put", Path: filename, Err: fs.ErrExist}
+	}
+	// plain SFTPv3 rename does not replace an existing file
+	return sftpClient.Rename(tmp, filename)
+}
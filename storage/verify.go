@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2025 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	plakarsftp "github.com/PlakarKorp/integration-sftp/common"
+)
+
+// ErrVerifyFailed is returned when an uploaded object does not hash to
+// the data that was written.
+var ErrVerifyFailed = errors.New("stored object does not match uploaded data")
+
+// digest hashes the data being uploaded with every algorithm we may be
+// able to get from the server.
+type digest struct {
+	sha256 hash.Hash
+	md5    hash.Hash
+}
+
+func newDigest() *digest {
+	return &digest{
+		sha256: sha256.New(),
+		md5:    md5.New(),
+	}
+}
+
+func (d *digest) Write(p []byte) (int, error) {
+	d.sha256.Write(p)
+	d.md5.Write(p)
+	return len(p), nil
+}
+
+func (d *digest) compare(algo string, sum []byte, filename string) error {
+	var want []byte
+	switch algo {
+	case "sha256":
+		want = d.sha256.Sum(nil)
+	case "md5":
+		want = d.md5.Sum(nil)
+	default:
+		return fmt.Errorf("unexpected hash algorithm %q", algo)
+	}
+
+	if !bytes.Equal(sum, want) {
+		return fmt.Errorf("%w: %s: %s %x, expected %x", ErrVerifyFailed, filename, algo, sum, want)
+	}
+	return nil
+}
+
+// verifyUpload checks that filename holds the data hashed in d, preferably
+// with a hash computed by the server, otherwise by reading it back.
+func verifyUpload(sftpClient *plakarsftp.Client, filename string, d *digest) error {
+	if algo, sum, err := sftpClient.CheckFile(filename, "sha256", "md5"); err == nil {
+		if algo == "sha256" || algo == "md5" {
+			return d.compare(algo, sum, filename)
+		}
+	}
+
+	if sum, err := sftpClient.MD5Hash(filename); err == nil {
+		return d.compare("md5", sum, filename)
+	}
+
+	fp, err := sftpClient.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, fp); err != nil {
+		return err
+	}
+	return d.compare("sha256", hasher.Sum(nil), filename)
+}